@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin wraps admin-only handlers. Callers must present
+// "Authorization: Bearer <ADMIN_TOKEN>"; when no token is configured the
+// admin endpoints are disabled entirely.
+func requireAdmin(config *Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+type CacheClearResponse struct {
+	Cleared int `json:"cleared"`
+}
+
+func handleCacheClear(cache *responseCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		cleared := cache.Clear()
+
+		writeJSON(w, http.StatusOK, CacheClearResponse{Cleared: cleared})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// averagedMetrics are the daily counter metrics ?average=daily covers.
+var averagedMetrics = []string{MetricGenerated, MetricConsumed, MetricExported, MetricImported, MetricDischarged}
+
+// DailyAverage holds a timeframe's metrics summed and averaged over its
+// local days, with ?average=daily.
+type DailyAverage struct {
+	Days    int                `json:"days"`
+	Total   map[string]float64 `json:"total"`
+	Average map[string]float64 `json:"average"`
+}
+
+// dayWindow is one local day of a timeframe.
+type dayWindow struct {
+	start, stop time.Time
+}
+
+// dayWindows splits a timeframe into the local days that start within it,
+// the last one running to the timeframe's stop. The partial day a trailing
+// window starts in is left out, so a week covers seven days.
+func dayWindows(config *Config, timeframe string) ([]dayWindow, error) {
+	start, stop, err := calculateRange(config, timeframe)
+	if err != nil {
+		return nil, err
+	}
+	end := stop
+	if end.IsZero() {
+		end = config.now()
+	}
+
+	day := dayStart(config, start)
+	if day.Before(start) {
+		day = nextDayStart(config, start)
+	}
+	var windows []dayWindow
+	for day.Before(end) {
+		next := nextDayStart(config, day)
+		window := dayWindow{day, next}
+		if !next.Before(end) {
+			// The last window keeps the timeframe's stop, which is zero
+			// for one running up to now
+			next, window.stop = end, stop
+		}
+		windows = append(windows, window)
+		day = next
+	}
+	if len(windows) == 0 {
+		// A window shorter than a day still counts as one
+		windows = append(windows, dayWindow{start, stop})
+	}
+	return windows, nil
+}
+
+// queryDayTotals sums each requested averagedMetric's daily values, in kWh,
+// over windows. Each day is its own query, so the daily counters are never
+// aggregated across a reset.
+func queryDayTotals(ctx context.Context, client influxdb2.Client, config *Config, windows []dayWindow, fields fieldSet) (map[string]float64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	metrics := slices.DeleteFunc(slices.Clone(averagedMetrics), func(metric string) bool { return !fields.Has(metric) })
+	derived := fields.Has(MetricConsumed) && config.ConsumptionMode != ConsumptionMeasured
+	if derived {
+		metrics = []string{MetricGenerated, MetricImported, MetricDischarged, MetricExported, MetricCharged}
+	}
+
+	var (
+		values   = make([]map[string]float64, len(windows))
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i, window := range windows {
+		values[i] = make(map[string]float64)
+		for _, metric := range metrics {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				value, err := queryMetricRange(ctx, client, config, metric, window.start, window.stop)
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+				mu.Lock()
+				values[i][metric] = value
+				mu.Unlock()
+			}()
+		}
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	totals := make(map[string]float64)
+	for _, day := range values {
+		if derived {
+			response := Response{
+				Generated:  day[MetricGenerated],
+				Imported:   day[MetricImported],
+				Discharged: day[MetricDischarged],
+				Exported:   day[MetricExported],
+			}
+			day[MetricConsumed] = deriveConsumption(config, response, day[MetricCharged])
+		}
+		for _, metric := range averagedMetrics {
+			if fields.Has(metric) {
+				totals[metric] += day[metric]
+			}
+		}
+	}
+	return totals, nil
+}
+
+// queryDailyAverage computes the DailyAverage of a timeframe across every
+// backend.
+func queryDailyAverage(ctx context.Context, backends []backend, config *Config, timeframe string, fields fieldSet) (*DailyAverage, error) {
+	windows, err := dayWindows(config, timeframe)
+	if err != nil {
+		return nil, err
+	}
+
+	perBackend := make([]map[string]float64, len(backends))
+	err = fanOut(ctx, backends, func(ctx context.Context, i int, b backend) error {
+		var err error
+		perBackend[i], err = queryDayTotals(ctx, b.client, b.config, windows, fields)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	average := &DailyAverage{Days: len(windows), Total: make(map[string]float64), Average: make(map[string]float64)}
+	for _, totals := range perBackend {
+		for metric, value := range totals {
+			average.Total[metric] += convertEnergy(config, value)
+		}
+	}
+	for metric, total := range average.Total {
+		average.Average[metric] = total / float64(average.Days)
+	}
+	return average, nil
+}
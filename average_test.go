@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDayWindowsOpenTimeframes(t *testing.T) {
+	frozen := time.Date(2024, 6, 21, 15, 30, 0, 0, time.UTC)
+	clocks := map[string]func() time.Time{
+		"frozen": func() time.Time { return frozen },
+		// Without a clock the open timeframes have a zero stop
+		"wall": nil,
+	}
+
+	for name, clock := range clocks {
+		for _, timeframe := range []string{"day", "week", "isoweek", "month"} {
+			t.Run(name+"/"+timeframe, func(t *testing.T) {
+				config := &Config{Clock: clock, RangePrecision: time.Minute}
+				_, stop, err := calculateRange(config, timeframe)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				windows, err := dayWindows(config, timeframe)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(windows) == 0 || len(windows) > 32 {
+					t.Fatalf("got %d windows, expected 1 to 32", len(windows))
+				}
+				for i := 1; i < len(windows); i++ {
+					if !windows[i].start.Equal(windows[i-1].stop) {
+						t.Errorf("window %d starts at %s, expected the previous stop %s", i, windows[i].start, windows[i-1].stop)
+					}
+				}
+				if last := windows[len(windows)-1]; !last.stop.Equal(stop) {
+					t.Errorf("last window stops at %s, expected the timeframe's stop %s", last.stop, stop)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"runtime/debug"
+	"slices"
+	"sync"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	influxlog "github.com/influxdata/influxdb-client-go/v2/log"
+)
+
+// BackendConfig describes one InfluxDB server and the dongles to query on
+// it. Multiple backends are configured as a JSON array in INFLUXDB_BACKENDS.
+type BackendConfig struct {
+	URL     string   `json:"url"`
+	Token   string   `json:"token"`
+	Org     string   `json:"org"`
+	Bucket  string   `json:"bucket"`
+	Dongles []string `json:"dongles"`
+
+	// Username and Password authenticate to InfluxDB 1.x in place of
+	// Token, which is then set to "username:password".
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// backend is a single dongle on a single InfluxDB server. Its config is a
+// copy of the global Config with the InfluxDB and dongle fields overridden,
+// so the query functions need no knowledge of multiple backends.
+type backend struct {
+	client influxdb2.Client
+	config *Config
+}
+
+// defaultUserAgent is "solarshowdown-api/<version>", with the module
+// version from the build info, or "dev" for a local build.
+func defaultUserAgent() string {
+	version := "dev"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	return "solarshowdown-api/" + version
+}
+
+// clientLogLevels maps INFLUXDB_CLIENT_LOG_LEVEL onto the InfluxDB client's
+// log levels.
+var clientLogLevels = map[string]uint{
+	"error": influxlog.ErrorLevel,
+	"warn":  influxlog.WarningLevel,
+	"info":  influxlog.InfoLevel,
+	"debug": influxlog.DebugLevel,
+}
+
+// newBackends creates one client per configured server and a backend per
+// dongle. The returned function closes every client.
+func newBackends(config *Config) ([]backend, func()) {
+	var (
+		backends []backend
+		clients  []influxdb2.Client
+	)
+
+	options := influxdb2.DefaultOptions().SetApplicationName(config.UserAgent)
+	if config.ClientLogLevel == "none" {
+		// The client only logs through this package-level logger
+		influxlog.Log = nil
+	} else {
+		options.SetLogLevel(clientLogLevels[config.ClientLogLevel])
+	}
+
+	for _, bc := range config.Backends {
+		client := influxdb2.NewClientWithOptions(bc.URL, bc.Token, options)
+		clients = append(clients, client)
+
+		for _, dongle := range bc.Dongles {
+			c := *config
+			c.InfluxDBURL = bc.URL
+			c.InfluxDBToken = bc.Token
+			c.InfluxDBOrg = bc.Org
+			c.InfluxDBBucket = bc.Bucket
+			c.Dongle = dongle
+			if override, ok := config.DongleOverrides[dongle]; ok {
+				override.apply(&c)
+			}
+			backends = append(backends, backend{client: client, config: &c})
+		}
+	}
+
+	return backends, func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}
+}
+
+// fanOut calls fn for every backend concurrently. The first failure cancels
+// the remaining calls and is returned.
+func fanOut(ctx context.Context, backends []backend, fn func(ctx context.Context, i int, b backend) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+
+	for i, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(ctx, i, b); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// queryBackends runs queryResponse against every backend and sums the
+// results. maxPv is the sum of each site's peak, an upper bound on the
+// combined instantaneous power.
+func queryBackends(ctx context.Context, backends []backend, config *Config, timeframe string, fields fieldSet) (Response, error) {
+	if len(backends) == 1 {
+		return queryResponse(ctx, backends[0].client, backends[0].config, timeframe, fields)
+	}
+
+	responses := make([]Response, len(backends))
+	err := fanOut(ctx, backends, func(ctx context.Context, i int, b backend) error {
+		var err error
+		responses[i], err = queryResponse(ctx, b.client, b.config, timeframe, fields)
+		return err
+	})
+	if err != nil {
+		return Response{}, err
+	}
+
+	total := Response{EnergyUnit: config.EnergyUnit, ResetGrace: responses[0].ResetGrace}
+	for i, response := range responses {
+		for _, warning := range response.Warnings {
+			if !slices.Contains(total.Warnings, warning) {
+				total.Warnings = append(total.Warnings, warning)
+			}
+		}
+		total.Generated += response.Generated
+		total.Consumed += response.Consumed
+		total.Exported += response.Exported
+		total.Imported += response.Imported
+		total.Discharged += response.Discharged
+		total.MaxPv += response.MaxPv
+		total.Surplus += response.Surplus
+		total.batteryKWh += response.batteryKWh
+		total.charged += response.charged
+		total.loadKW += response.loadKW
+		for measurement, value := range response.Raw {
+			if total.Raw == nil {
+				total.Raw = make(map[string]float64)
+			}
+			total.Raw[backends[i].config.Dongle+"/"+measurement] = value
+		}
+		total.Missing = append(total.Missing, response.Missing...)
+		total.Partial = total.Partial || response.Partial
+		total.unresolved = append(total.unresolved, response.unresolved...)
+		if response.EstimatedSavings != nil {
+			if total.EstimatedSavings == nil {
+				total.EstimatedSavings = new(float64)
+			}
+			*total.EstimatedSavings += *response.EstimatedSavings
+		}
+	}
+	total.EstimatedRuntimeMinutes = estimateRuntime(total.batteryKWh, total.loadKW)
+	total.GridIndependencePct, total.GridDependencePct = gridReliance(total)
+	total.BatteryRoundTripPct = batteryRoundTrip(total)
+	total.ProjectedDailyGenerated = projectDaily(config, timeframe, total.Generated)
+	total.ExpectedGenerated, total.PerformanceRatioPct = clearSkyComparison(config, timeframe, total.Generated)
+	slices.Sort(total.Missing)
+	total.Missing = slices.Compact(total.Missing)
+	if total.EstimatedSavings != nil {
+		total.EstimatedSavingsFormatted = formatCurrency(config, *total.EstimatedSavings)
+	}
+
+	if len(config.ExtraMeasurements) > 0 {
+		total.Extra = make(map[string]float64, len(config.ExtraMeasurements))
+		for _, extra := range config.ExtraMeasurements {
+			values := make([]float64, len(responses))
+			for i, response := range responses {
+				values[i] = response.Extra[extra.Key]
+			}
+			total.Extra[extra.Key] = combineExtra(extra.Aggregation, values)
+		}
+	}
+
+	return total, nil
+}
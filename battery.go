@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// instantWindow is how far back the latest instantaneous reading may be
+// for the battery runtime estimate.
+const instantWindow = time.Hour
+
+// instantQuery returns a metricQuery for the latest reading of an
+// instantaneous metric, regardless of the request's timeframe.
+func instantQuery(metric string) metricQuery {
+	return func(ctx context.Context, client influxdb2.Client, config *Config, timeframe string) (float64, error) {
+		now := config.now()
+		stop := zeroTime
+		if config.Clock != nil {
+			stop = now.UTC()
+		}
+		return queryMetricRange(ctx, client, config, metric, now.Add(-instantWindow).UTC(), stop)
+	}
+}
+
+// estimateRuntime returns how many minutes batteryKWh of stored energy
+// lasts at loadKW, or nil when either is unknown or zero.
+func estimateRuntime(batteryKWh, loadKW float64) *float64 {
+	if batteryKWh <= 0 || loadKW <= 0 {
+		return nil
+	}
+	minutes := batteryKWh / loadKW * 60
+	return &minutes
+}
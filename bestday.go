@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type BestDayResponse struct {
+	Date      string  `json:"date"`
+	Generated float64 `json:"generated"`
+	Days      int     `json:"days"`
+}
+
+// handleBestDay serves the day with the most generation among the last days
+// local calendar days, today so far included. The earliest day wins a tie.
+func handleBestDay(backends []backend, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		days := 30 // Default window
+		if v := r.URL.Query().Get("days"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > config.DailyMaxDays {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{
+					Error:     fmt.Sprintf("days must be between 1 and %d", config.DailyMaxDays),
+					ErrorCode: ErrorCodeInvalidParameter,
+				})
+				return
+			}
+			days = n
+		}
+		days = min(days, config.DailyMaxDays)
+
+		results, err := queryDailyBackends(r.Context(), backends, days, nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error(), ErrorCode: errorCode(err)})
+			return
+		}
+
+		best := results[0]
+		for _, day := range results[1:] {
+			if day.Generated > best.Generated {
+				best = day
+			}
+		}
+
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Type", "application/json")
+			return
+		}
+		writeJSON(w, http.StatusOK, BestDayResponse{Date: best.Date, Generated: best.Generated, Days: days})
+	}
+}
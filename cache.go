@@ -0,0 +1,124 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	key      string
+	response Response
+	stored   time.Time
+	ttl      time.Duration
+}
+
+// responseCache holds recent Responses keyed by request parameters. Entries
+// are fresh for the TTL they were stored with and, when staleMaxAge is
+// longer, retained until then so they can be served as a fallback while
+// InfluxDB is failing. An entry with neither is never stored. Once
+// maxEntries is reached the least recently used entry is evicted; zero
+// leaves the cache unbounded.
+type responseCache struct {
+	mu          sync.Mutex
+	staleMaxAge time.Duration
+	maxEntries  int
+	entries     map[string]*list.Element
+	lru         *list.List // Front is most recently used
+}
+
+func newResponseCache(staleMaxAge time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		staleMaxAge: staleMaxAge,
+		maxEntries:  maxEntries,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// lookup returns the entry for key if it is younger than maxAge, or than its
+// own TTL when maxAge is zero, dropping it once it is too old to be of any
+// further use.
+func (c *responseCache) lookup(key string, maxAge time.Duration) (Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return Response{}, false
+	}
+	entry := elem.Value.(*cacheEntry)
+
+	age := time.Since(entry.stored)
+	if age >= max(entry.ttl, c.staleMaxAge) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return Response{}, false
+	}
+	if maxAge == 0 {
+		maxAge = entry.ttl
+	}
+	if age >= maxAge {
+		return Response{}, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return entry.response, true
+}
+
+// Get returns the cached Response for key if it is still fresh.
+func (c *responseCache) Get(key string) (Response, bool) {
+	return c.lookup(key, 0)
+}
+
+// GetStale returns the cached Response for key, fresh or not, if it is
+// within the stale-serving window.
+func (c *responseCache) GetStale(key string) (Response, bool) {
+	if c.staleMaxAge <= 0 {
+		return Response{}, false
+	}
+	return c.lookup(key, c.staleMaxAge)
+}
+
+// Set stores response under key, fresh for ttl.
+func (c *responseCache) Set(key string, response Response, ttl time.Duration) {
+	if ttl <= 0 && c.staleMaxAge <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, response: response, stored: time.Now(), ttl: ttl}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	if c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Len returns the number of entries currently held.
+func (c *responseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// Clear empties the cache and returns the number of entries removed.
+func (c *responseCache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.lru.Len()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	return n
+}
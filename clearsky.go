@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// clearSkyStep is the integration step of expectedClearSky.
+const clearSkyStep = 5 * time.Minute
+
+// solarCosZenith returns the cosine of the sun's zenith angle at t for a
+// latitude and longitude in degrees, using NOAA's low-precision solar
+// position equations. It is negative while the sun is below the horizon.
+func solarCosZenith(t time.Time, latitude, longitude float64) float64 {
+	t = t.UTC()
+	hour := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+	gamma := 2 * math.Pi / 365 * (float64(t.YearDay()-1) + (hour-12)/24)
+
+	eqTime := 229.18 * (0.000075 + 0.001868*math.Cos(gamma) - 0.032077*math.Sin(gamma) -
+		0.014615*math.Cos(2*gamma) - 0.040849*math.Sin(2*gamma))
+	decl := 0.006918 - 0.399912*math.Cos(gamma) + 0.070257*math.Sin(gamma) -
+		0.006758*math.Cos(2*gamma) + 0.000907*math.Sin(2*gamma) -
+		0.002697*math.Cos(3*gamma) + 0.00148*math.Sin(3*gamma)
+
+	solarMinutes := hour*60 + eqTime + 4*longitude
+	hourAngle := (solarMinutes/4 - 180) * math.Pi / 180
+	lat := latitude * math.Pi / 180
+	return math.Sin(lat)*math.Sin(decl) + math.Cos(lat)*math.Cos(decl)*math.Cos(hourAngle)
+}
+
+// clearSkyIrradiance is the Haurwitz model's global horizontal irradiance
+// in W/m² for a cosine of the zenith angle.
+func clearSkyIrradiance(cosZenith float64) float64 {
+	if cosZenith <= 0 {
+		return 0
+	}
+	return 1098 * cosZenith * math.Exp(-0.057/cosZenith)
+}
+
+// expectedClearSky returns Response.ExpectedGenerated in kWh: what a
+// SYSTEM_CAPACITY_KW array would produce over the timeframe under a clear
+// sky at LATITUDE/LONGITUDE, rated at 1000 W/m². It ignores tilt,
+// orientation and losses, so only the trend is meaningful. Nil unless all
+// three are configured.
+func expectedClearSky(config *Config, timeframe string) *float64 {
+	if config.SystemCapacityKW <= 0 || config.Latitude == nil || config.Longitude == nil {
+		return nil
+	}
+	start, stop, err := calculateRange(config, timeframe)
+	if err != nil {
+		return nil
+	}
+	if stop.IsZero() {
+		stop = config.now()
+	}
+
+	var kwh float64
+	for t := start; t.Before(stop); t = t.Add(clearSkyStep) {
+		step := min(clearSkyStep, stop.Sub(t))
+		mid := t.Add(step / 2)
+		irradiance := clearSkyIrradiance(solarCosZenith(mid, *config.Latitude, *config.Longitude))
+		kwh += config.SystemCapacityKW * irradiance / 1000 * step.Hours()
+	}
+	return &kwh
+}
+
+// performanceRatio returns Response.PerformanceRatioPct, generated as a
+// percentage of the clear-sky expectation, or nil without one.
+func performanceRatio(generated float64, expected *float64) *float64 {
+	if expected == nil || *expected <= 0 {
+		return nil
+	}
+	ratio := generated / *expected * 100
+	return &ratio
+}
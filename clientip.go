@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// clientIP identifies the client behind r: the peer address, or with
+// TRUST_PROXY the TrustProxyIndex entry of X-Forwarded-For.
+func clientIP(config *Config, r *http.Request) string {
+	if config.TrustProxy {
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			var hops []string
+			for _, header := range xff {
+				for _, hop := range strings.Split(header, ",") {
+					hops = append(hops, strings.TrimSpace(hop))
+				}
+			}
+
+			i := config.TrustProxyIndex
+			if i < 0 {
+				i += len(hops)
+			}
+			if i >= 0 && i < len(hops) && net.ParseIP(hops[i]) != nil {
+				return hops[i]
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// withClientIP stores the request's clientIP in its context for logf.
+func withClientIP(config *Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, clientIP(config, r))))
+	})
+}
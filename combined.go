@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// combinable reports whether metric can be part of the combined query.
+// maxPv from PV_POWER_STRINGS or under MAX_PV_CAP, and metrics with a
+// MAX_DAILY_KWH ceiling, need their per-measurement queries.
+func combinable(config *Config, metric string) bool {
+	if metric == MetricMaxPv && (len(config.PvPowerStrings) > 0 || config.MaxPvCapKW > 0) {
+		return false
+	}
+	_, ceiling := config.DailyCeilings[metric]
+	return !ceiling
+}
+
+// queryCombined computes metrics over a timeframe with a single Flux query,
+// the COMBINED_QUERY alternative to one query per measurement.
+func queryCombined(ctx context.Context, client influxdb2.Client, config *Config, timeframe string, metrics []string) (map[string]float64, error) {
+	start, stop, err := calculateRange(config, timeframe)
+	if err != nil {
+		return nil, err
+	}
+	query := metricsFluxQuery(config, metrics, start, stop, true)
+
+	if err := acquireQuerySlot(ctx); err != nil {
+		return nil, fmt.Errorf("waiting to query metrics: %w", err)
+	}
+	defer releaseQuerySlot()
+	defer observeQuery(ctx, config, "combined query", time.Now())
+
+	result, err := client.QueryAPI(config.InfluxDBOrg).Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("combined query failed: %w", err)
+	}
+	defer result.Close()
+
+	// Each aggregate yields one row per series, keyed here by aggregation
+	// and measurement name
+	type seriesKey struct{ aggregation, name string }
+	rows := make(map[seriesKey]float64)
+	for result.Next() {
+		record := result.Record()
+		name := record.Measurement()
+		if config.PivotedSchema {
+			name = record.Field()
+		}
+		aggregation, _ := record.ValueByKey("aggregation").(string)
+		key := seriesKey{aggregation, name}
+
+		if _, ok := rows[key]; ok {
+			return nil, fmt.Errorf("reading result for %s: query matched more than one series; check that the dongle filter is specific enough", name)
+		}
+		if record.Value() == nil {
+			rows[key] = 0
+			continue
+		}
+		value, err := numericValue(config, record.Value(), name)
+		if err != nil {
+			return nil, fmt.Errorf("reading result for %s: %w", name, err)
+		}
+		rows[key] = value
+		recordRaw(ctx, name, value)
+	}
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("reading combined result: %w", err)
+	}
+
+	values := make(map[string]float64, len(metrics))
+	for _, metric := range metrics {
+		source := config.Metrics[metric]
+		var total float64
+		for _, measurement := range source.Measurements {
+			total += rows[seriesKey{metricAggregation(config, metric, start, stop), measurement}]
+		}
+		values[metric] = total * source.Scale
+	}
+
+	return values, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Comparison sets the Response against the previous period of the same
+// length, with ?compare=true.
+type Comparison struct {
+	Previous map[string]float64 `json:"previous"`
+	// ChangePct is (current - previous) / previous * 100 for each metric,
+	// null when the previous value was zero.
+	ChangePct map[string]*float64 `json:"changePct"`
+}
+
+// comparedMetrics are the Response fields a Comparison covers.
+var comparedMetrics = []string{
+	MetricGenerated, MetricConsumed, MetricExported, MetricImported, MetricDischarged, MetricMaxPv, "surplus",
+}
+
+// previousPeriod returns how to step back from a timeframe's "now" to the
+// same point in the previous period.
+func previousPeriod(timeframe string) func(time.Time) time.Time {
+	switch timeframe {
+	case "week", "isoweek":
+		return func(t time.Time) time.Time { return t.AddDate(0, 0, -7) }
+	case "month":
+		return func(t time.Time) time.Time { return t.AddDate(0, -1, 0) }
+	default:
+		return func(t time.Time) time.Time { return t.AddDate(0, 0, -1) }
+	}
+}
+
+// shiftClock returns a copy of config whose clock runs at shift(now), so
+// every timeframe covers the previous period up to the same point in it.
+func shiftClock(config *Config, shift func(time.Time) time.Time) *Config {
+	shifted := *config
+	shifted.Clock = func() time.Time { return shift(config.now()) }
+	return &shifted
+}
+
+// queryPrevious computes the Response for the period before timeframe's.
+func queryPrevious(ctx context.Context, backends []backend, config *Config, timeframe string, fields fieldSet) (Response, error) {
+	if month, ok := calendarMonth(timeframe); ok {
+		// A calendar month is fixed, so step to the one before instead of
+		// shifting the clock
+		return queryBackends(ctx, backends, config, month.AddDate(0, -1, 0).Format("2006-01"), fields)
+	}
+	shift := previousPeriod(timeframe)
+	previous := make([]backend, len(backends))
+	for i, b := range backends {
+		previous[i] = backend{client: b.client, config: shiftClock(b.config, shift)}
+	}
+	return queryBackends(ctx, previous, shiftClock(config, shift), timeframe, fields)
+}
+
+// metricValues returns the compared fields of a Response by name.
+func metricValues(response Response) map[string]float64 {
+	return map[string]float64{
+		MetricGenerated:  response.Generated,
+		MetricConsumed:   response.Consumed,
+		MetricExported:   response.Exported,
+		MetricImported:   response.Imported,
+		MetricDischarged: response.Discharged,
+		MetricMaxPv:      response.MaxPv,
+		"surplus":        response.Surplus,
+	}
+}
+
+// compareResponses builds the Comparison of current against previous,
+// limited to the requested fields.
+func compareResponses(current, previous Response, fields fieldSet) *Comparison {
+	now, before := metricValues(current), metricValues(previous)
+	comparison := &Comparison{Previous: make(map[string]float64), ChangePct: make(map[string]*float64)}
+	for _, name := range comparedMetrics {
+		if !fields.Has(name) {
+			continue
+		}
+		comparison.Previous[name] = before[name]
+		comparison.ChangePct[name] = nil
+		if before[name] != 0 {
+			// Relative to the baseline's size, so a smaller deficit in
+			// surplus reads as an increase
+			pct := (now[name] - before[name]) / math.Abs(before[name]) * 100
+			comparison.ChangePct[name] = &pct
+		}
+	}
+	return comparison
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// countedMetrics are the metrics ?counts=true reports sample counts for.
+var countedMetrics = []string{MetricGenerated, MetricConsumed, MetricExported, MetricImported, MetricDischarged, MetricMaxPv}
+
+// queryCounts returns how many samples back each requested countedMetric
+// over timeframe, summed over the metric's measurements.
+func queryCounts(ctx context.Context, client influxdb2.Client, config *Config, timeframe string, fields fieldSet) (map[string]int64, error) {
+	config = downsampledConfig(config, timeframe)
+	start, stop, err := calculateRange(config, timeframe)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		counts   = make(map[string]int64)
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for _, metric := range countedMetrics {
+		if !fields.Has(metric) {
+			continue
+		}
+		measurements := config.Metrics[metric].Measurements
+		if metric == MetricMaxPv && len(config.PvPowerStrings) > 0 {
+			measurements = config.PvPowerStrings
+		}
+		counts[metric] = 0
+		for _, measurement := range measurements {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				n, err := countPoints(ctx, client, config, measurement, start, stop)
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+				mu.Lock()
+				counts[metric] += n
+				mu.Unlock()
+			}()
+		}
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return counts, nil
+}
+
+// queryBackendCounts sums queryCounts across every backend. Demo mode has
+// no samples to count.
+func queryBackendCounts(ctx context.Context, backends []backend, config *Config, timeframe string, fields fieldSet) (map[string]int64, error) {
+	if config.DemoMode {
+		return nil, nil
+	}
+
+	perBackend := make([]map[string]int64, len(backends))
+	err := fanOut(ctx, backends, func(ctx context.Context, i int, b backend) error {
+		var err error
+		perBackend[i], err = queryCounts(ctx, b.client, b.config, timeframe, fields)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64)
+	for _, backendCounts := range perBackend {
+		for metric, n := range backendCounts {
+			counts[metric] += n
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// combinedFluxQuery builds one Flux query returning the aggregate of every
+// measurement behind the Response metrics, one table per measurement. The
+// values are as stored, before any scaling.
+func combinedFluxQuery(config *Config, timeframe string) (string, error) {
+	config = downsampledConfig(config, timeframe)
+	start, stop, err := calculateRange(config, timeframe)
+	if err != nil {
+		return "", err
+	}
+
+	metrics := []string{MetricGenerated, MetricConsumed, MetricExported, MetricImported, MetricDischarged, MetricMaxPv}
+	return metricsFluxQuery(config, metrics, start, stop, false), nil
+}
+
+// metricsFluxQuery builds one Flux query aggregating every measurement
+// behind metrics over [start, stop). With tag, each row carries its
+// aggregation in an "aggregation" column, so a measurement used with two
+// aggregations can be told apart.
+func metricsFluxQuery(config *Config, metrics []string, start, stop time.Time, tag bool) string {
+	// Group the measurements by aggregation so each needs only one stream
+	byAggregation := make(map[string][]string)
+	for _, metric := range metrics {
+		aggregation := metricAggregation(config, metric, start, stop)
+		for _, measurement := range config.Metrics[metric].Measurements {
+			if !slices.Contains(byAggregation[aggregation], measurement) {
+				byAggregation[aggregation] = append(byAggregation[aggregation], measurement)
+			}
+		}
+	}
+
+	aggregations := make([]string, 0, len(byAggregation))
+	for aggregation := range byAggregation {
+		aggregations = append(aggregations, aggregation)
+	}
+	slices.Sort(aggregations)
+
+	var streams []string
+	for _, aggregation := range aggregations {
+		stream := fmt.Sprintf(`
+		from(bucket:"%[1]s")
+			|> range(%[2]s)
+			|> %[3]s
+			|> filter(fn: (r) => r["%[4]s"] == "%[5]s")
+			|> %[6]s`,
+			config.InfluxDBBucket,
+			fluxRange(start, stop),
+			seriesFilter(config, byAggregation[aggregation]...),
+			config.TagKey,
+			config.Dongle,
+			fluxAggregate(aggregation))
+		if tag {
+			stream += fmt.Sprintf(`
+			|> set(key: "aggregation", value: "%s")`, aggregation)
+		}
+		streams = append(streams, stream)
+	}
+
+	if len(streams) == 1 {
+		return streams[0]
+	}
+	return "union(tables: [" + strings.Join(streams, ",") + "\n\t\t])"
+}
+
+// streamInfluxCSV runs query and copies InfluxDB's annotated CSV response
+// to w as it arrives, without decoding it.
+func streamInfluxCSV(ctx context.Context, client influxdb2.Client, config *Config, query string, w io.Writer) error {
+	body, err := json.Marshal(map[string]any{
+		"query":   query,
+		"type":    "flux",
+		"dialect": influxdb2.DefaultDialect(),
+	})
+	if err != nil {
+		return err
+	}
+
+	queryURL := client.HTTPService().ServerAPIURL() + "query?org=" + url.QueryEscape(config.InfluxDBOrg)
+
+	if err := acquireQuerySlot(ctx); err != nil {
+		return fmt.Errorf("waiting to query: %w", err)
+	}
+	defer releaseQuerySlot()
+	defer observeQuery(ctx, config, "influx-csv query", time.Now())
+
+	perr := client.HTTPService().DoPostRequest(ctx, queryURL, bytes.NewReader(body),
+		func(req *http.Request) {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Accept", "text/csv")
+		},
+		func(resp *http.Response) error {
+			_, err := io.Copy(flushWriter{w}, resp.Body)
+			return err
+		})
+	if perr != nil {
+		return fmt.Errorf("combined query failed: %w", perr)
+	}
+	return nil
+}
+
+// flushWriter flushes after every write so the client sees rows as soon as
+// InfluxDB produces them.
+type flushWriter struct {
+	w io.Writer
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// startedWriter records whether anything has been written, i.e. whether
+// it is still possible to respond with an error status instead.
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (s *startedWriter) Write(p []byte) (int, error) {
+	s.started = true
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *startedWriter) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// serveInfluxCSV answers ?format=influx-csv by streaming each backend's
+// annotated CSV in turn, separated by blank lines as between CSV results.
+func serveInfluxCSV(w http.ResponseWriter, r *http.Request, backends []backend, timeframe string) {
+	queries := make([]string, len(backends))
+	for i, b := range backends {
+		var err error
+		if queries[i], err = combinedFluxQuery(b.config, timeframe); err != nil {
+			writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidTimeframe, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	sw := &startedWriter{ResponseWriter: w}
+	for i, b := range backends {
+		if i > 0 {
+			io.WriteString(sw, "\n")
+		}
+		if err := streamInfluxCSV(r.Context(), b.client, b.config, queries[i], sw); err != nil {
+			if !sw.started {
+				writeResponseError(w, http.StatusInternalServerError, errorCode(err), err)
+				return
+			}
+			// The CSV is already partly sent, so the error can only be
+			// logged and the stream cut short.
+			logf(r.Context(), "Streaming influx-csv from %s failed: %v", b.config.InfluxDBURL, err)
+			return
+		}
+	}
+}
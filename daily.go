@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+type DailyGeneration struct {
+	Date      string  `json:"date"`
+	Generated float64 `json:"generated"`
+}
+
+// queryDaily returns the generated total for each of the last days local
+// calendar days, oldest first, ending with today so far. If resolved is
+// non-nil it is called with each day and its index as that day's query
+// completes, in whatever order they finish.
+func queryDaily(ctx context.Context, client influxdb2.Client, config *Config, days int, resolved func(i int, day DailyGeneration)) ([]DailyGeneration, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		now      = config.now()
+		results  = make([]DailyGeneration, days)
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+
+	for i := range results {
+		// AddDate keeps the window on local midnight across DST changes
+		date := now.AddDate(0, 0, i-days+1)
+		start := dayStart(config, date)
+		stop := dayStart(config, date.AddDate(0, 0, 1))
+		if i == days-1 {
+			// Today is still in progress
+			stop = zeroTime
+			if config.Clock != nil {
+				stop = now.UTC()
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			generated, err := queryMetricRange(ctx, client, config, MetricGenerated, start, stop)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			results[i] = DailyGeneration{
+				Date:      start.In(time.Local).Format(time.DateOnly),
+				Generated: convertEnergy(config, generated),
+			}
+			if resolved != nil {
+				resolved(i, results[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return results, nil
+}
+
+// queryDailyBackends runs queryDaily against every backend and sums the
+// generation for each day. If emit is non-nil it is called with each day,
+// oldest first, as soon as every backend has resolved that day and the
+// ones before it, and no longer once a query has failed.
+func queryDailyBackends(ctx context.Context, backends []backend, days int, emit func(DailyGeneration)) ([]DailyGeneration, error) {
+	var resolved func(ctx context.Context) func(i int, day DailyGeneration)
+	if emit != nil {
+		var (
+			mu      sync.Mutex
+			totals  = make([]DailyGeneration, days)
+			pending = make([]int, days)
+			next    int
+		)
+		for i := range pending {
+			pending[i] = len(backends)
+		}
+		resolved = func(ctx context.Context) func(int, DailyGeneration) {
+			return func(i int, day DailyGeneration) {
+				mu.Lock()
+				defer mu.Unlock()
+				totals[i].Date = day.Date
+				totals[i].Generated += day.Generated
+				pending[i]--
+				for next < days && pending[next] == 0 && ctx.Err() == nil {
+					emit(totals[next])
+					next++
+				}
+			}
+		}
+	}
+
+	perBackend := make([][]DailyGeneration, len(backends))
+	err := fanOut(ctx, backends, func(ctx context.Context, i int, b backend) error {
+		var onDay func(int, DailyGeneration)
+		if resolved != nil {
+			onDay = resolved(ctx)
+		}
+		var err error
+		perBackend[i], err = queryDaily(ctx, b.client, b.config, days, onDay)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := perBackend[0]
+	for _, other := range perBackend[1:] {
+		for i := range results {
+			results[i].Generated += other[i].Generated
+		}
+	}
+
+	return results, nil
+}
+
+func handleDaily(backends []backend, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		days := 30 // Default window
+		if v := r.URL.Query().Get("days"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > config.DailyMaxDays {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{
+					Error:     fmt.Sprintf("days must be between 1 and %d", config.DailyMaxDays),
+					ErrorCode: ErrorCodeInvalidParameter,
+				})
+				return
+			}
+			days = n
+		}
+		days = min(days, config.DailyMaxDays)
+
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "ndjson" {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{
+				Error:     fmt.Sprintf("invalid format: %s", format),
+				ErrorCode: ErrorCodeInvalidParameter,
+			})
+			return
+		}
+
+		var ndjson *ndjsonWriter
+		var emit func(DailyGeneration)
+		if format == "ndjson" && r.Method != http.MethodHead {
+			ndjson = &ndjsonWriter{w: w}
+			emit = func(day DailyGeneration) { ndjson.write(day) }
+		}
+
+		results, err := queryDailyBackends(r.Context(), backends, days, emit)
+		if err != nil {
+			if ndjson != nil && ndjson.started {
+				// The 200 is already out, so end the stream with the error
+				logf(r.Context(), "daily: stream failed after %d day(s): %v", ndjson.lines, err)
+				ndjson.write(ErrorResponse{Error: err.Error(), ErrorCode: errorCode(err)})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error(), ErrorCode: errorCode(err)})
+			return
+		}
+
+		if format == "ndjson" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			return
+		}
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Type", "application/json")
+			return
+		}
+		writeJSON(w, http.StatusOK, results)
+	}
+}
+
+// ndjsonWriter streams /daily?format=ndjson, writing each value as its own
+// line of JSON and flushing it so consumers see days as they resolve. The
+// status and Content-Type go out with the first line, so a query that
+// fails before any day resolves still gets its error status.
+type ndjsonWriter struct {
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	started bool
+	lines   int
+}
+
+func (n *ndjsonWriter) write(v any) {
+	if !n.started {
+		n.w.Header().Set("Content-Type", "application/x-ndjson")
+		n.enc = json.NewEncoder(n.w)
+		n.started = true
+	}
+	if err := n.enc.Encode(v); err != nil {
+		return
+	}
+	n.lines++
+	if flusher, ok := n.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type ResetTimeResponse struct {
+	NextReset    time.Time `json:"nextReset"`
+	SecondsUntil int64     `json:"secondsUntil"`
+}
+
+// handleResetTime reports when the daily counters next reset, so clients can
+// suppress the transient drop to zero around the boundary.
+func handleResetTime(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := config.now()
+		next := nextDayStart(config, now)
+
+		writeJSON(w, http.StatusOK, ResetTimeResponse{
+			NextReset:    config.responseTime(next),
+			SecondsUntil: int64(next.Sub(now).Seconds()),
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDailyNDJSONStreams(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.Local)
+	today := "stop: " + now.UTC().Format(time.RFC3339)
+
+	// Hold today's query until the earlier days have reached the client
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	client := fakeInfluxDB(t, func(query string) string {
+		if strings.Contains(query, today) {
+			<-release
+		}
+		// Each of the three PV strings generated 4.5 kWh
+		return ",,0,2024-01-01T00:00:00Z,2024-01-02T00:00:00Z,4.5,lux_Epv1_day"
+	})
+
+	config := testConfig()
+	config.Clock = func() time.Time { return now }
+	config.DailyMaxDays = 90
+	server := httptest.NewServer(handleDaily([]backend{{client, config}}, config))
+	defer server.Close()
+	defer unblock()
+
+	// Without streaming the first line never arrives, so don't wait forever
+	httpClient := server.Client()
+	httpClient.Timeout = 5 * time.Second
+	resp, err := httpClient.Get(server.URL + "?days=3&format=ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", got)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	want := []string{"2024-06-13", "2024-06-14", "2024-06-15"}
+	for i, date := range want {
+		if i == len(want)-1 {
+			unblock()
+		}
+		if !lines.Scan() {
+			t.Fatalf("stream ended after %d line(s): %v", i, lines.Err())
+		}
+		var day DailyGeneration
+		if err := json.Unmarshal(lines.Bytes(), &day); err != nil {
+			t.Fatal(err)
+		}
+		if day.Date != date || day.Generated != 13.5 {
+			t.Errorf("line %d = %+v, want %s with 13.5", i, day, date)
+		}
+	}
+	if lines.Scan() {
+		t.Errorf("unexpected line %q", lines.Text())
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// redactedConfig returns a copy of config safe to expose: tokens and the
+// webhook URL, which often embeds one, are replaced by redact.
+func redactedConfig(config *Config) Config {
+	c := *config
+	c.InfluxDBToken = redact(c.InfluxDBToken)
+	c.AdminToken = redact(c.AdminToken)
+	c.WebhookURL = redact(c.WebhookURL)
+	c.Backends = slices.Clone(c.Backends)
+	for i := range c.Backends {
+		c.Backends[i].Token = redact(c.Backends[i].Token)
+		c.Backends[i].Password = redact(c.Backends[i].Password)
+	}
+	return c
+}
+
+// handleDebugConfig returns the resolved Config with secrets redacted, to
+// check what a running instance was actually started with.
+func handleDebugConfig(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, redactedConfig(config))
+	}
+}
+
+// debugMetrics are the metrics /debug/queries lists, in Response order.
+var debugMetrics = []string{MetricGenerated, MetricConsumed, MetricExported, MetricImported, MetricDischarged, MetricMaxPv, MetricCharged}
+
+type DebugQueries struct {
+	Timeframe string           `json:"timeframe"`
+	Start     time.Time        `json:"start"`
+	Stop      *time.Time       `json:"stop"`
+	Backends  []BackendQueries `json:"backends"`
+}
+
+// BackendQueries is the Flux one dongle runs for a timeframe: a query per
+// measurement of each metric, and with COMBINED_QUERY, the single query
+// reading every metric it covers, which are then not listed separately.
+type BackendQueries struct {
+	Dongle   string                  `json:"dongle"`
+	Metrics  map[string][]DebugQuery `json:"metrics"`
+	Combined *DebugQuery             `json:"combined,omitempty"`
+}
+
+type DebugQuery struct {
+	Measurements []string `json:"measurements"`
+	Flux         string   `json:"flux"`
+}
+
+// debugFlux tidies a query's indentation for pasting into the InfluxDB UI.
+func debugFlux(query string) string {
+	return strings.ReplaceAll(strings.TrimSpace(query), "\n\t\t", "\n")
+}
+
+// backendQueries builds, without running them, the queries queryResponse
+// would send for every metric of timeframe.
+func backendQueries(config *Config, timeframe string, start, stop time.Time) BackendQueries {
+	config = downsampledConfig(config, timeframe)
+	queries := BackendQueries{Dongle: config.Dongle, Metrics: make(map[string][]DebugQuery)}
+
+	var combined []string
+	for _, metric := range debugMetrics {
+		source, ok := config.Metrics[metric]
+		if !ok {
+			continue
+		}
+		if config.CombinedQuery && combinable(config, metric) {
+			combined = append(combined, metric)
+			continue
+		}
+		if metric == MetricMaxPv && len(config.PvPowerStrings) > 0 {
+			queries.Metrics[metric] = []DebugQuery{{
+				Measurements: config.PvPowerStrings,
+				Flux:         debugFlux(pvStringsPeakQuery(config, start, stop)),
+			}}
+			continue
+		}
+		for _, measurement := range source.Measurements {
+			queries.Metrics[metric] = append(queries.Metrics[metric], DebugQuery{
+				Measurements: []string{measurement},
+				Flux:         debugFlux(aggregateQuery(config, measurement, metricAggregation(config, metric, start, stop), start, stop)),
+			})
+		}
+	}
+
+	if len(combined) > 0 {
+		var measurements []string
+		for _, metric := range combined {
+			measurements = append(measurements, config.Metrics[metric].Measurements...)
+		}
+		queries.Combined = &DebugQuery{
+			Measurements: measurements,
+			Flux:         debugFlux(metricsFluxQuery(config, combined, start, stop, true)),
+		}
+	}
+	return queries
+}
+
+// handleDebugQueries returns the Flux each dongle would run for
+// ?timeframe=, for replaying it in the InfluxDB UI. Nothing is executed.
+func handleDebugQueries(backends []backend, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeframe, ok := queryTimeframe(w, r, config)
+		if !ok {
+			return
+		}
+		// Validated by queryTimeframe
+		start, stop, _ := calculateRange(config, timeframe)
+
+		debug := DebugQueries{Timeframe: timeframe, Start: config.responseTime(start)}
+		if !stop.IsZero() {
+			stop := config.responseTime(stop)
+			debug.Stop = &stop
+		}
+		for _, b := range backends {
+			debug.Backends = append(debug.Backends, backendQueries(b.config, timeframe, start, stop))
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, debug)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugQueriesResponseTZ(t *testing.T) {
+	tz, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	config := testConfig()
+	config.ResponseTZ = tz
+	config.Clock = func() time.Time { return time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC) }
+
+	rec := httptest.NewRecorder()
+	handleDebugQueries([]backend{{config: config}}, config)(rec, httptest.NewRequest("GET", "/debug/queries?timeframe=week", nil))
+	var body struct {
+		Start, Stop string
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	for name, ts := range map[string]string{"start": body.Start, "stop": body.Stop} {
+		if !strings.HasSuffix(ts, "-04:00") {
+			t.Errorf("%s = %q, want it in RESPONSE_TZ", name, ts)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// deltaMetrics are the daily counters ?since= reports increments of.
+var deltaMetrics = []string{MetricGenerated, MetricConsumed, MetricExported, MetricImported, MetricDischarged}
+
+// Delta is what the counters gained since the poll that returned the
+// cursor passed as ?since=.
+type Delta struct {
+	Values map[string]float64 `json:"values"`
+	// Seconds is the time elapsed since that poll.
+	Seconds int64 `json:"seconds"`
+	// Reset is set when a counter restarted in between, e.g. at the daily
+	// reset; its delta is then its whole current value, so the energy from
+	// before the restart is missing.
+	Reset bool `json:"reset,omitempty"`
+}
+
+// cursor is the state a client echoes back as ?since=, so the server
+// keeps none. Day identifies the counter day the values belong to.
+type cursor struct {
+	Day    string             `json:"d"`
+	Time   int64              `json:"t"`
+	Values map[string]float64 `json:"v"`
+}
+
+// newCursor encodes the requested deltaMetrics of response as an opaque
+// cursor for the next poll.
+func newCursor(config *Config, response Response, fields fieldSet) string {
+	now := config.now()
+	c := cursor{
+		Day:    counterDay(config),
+		Time:   now.Unix(),
+		Values: make(map[string]float64),
+	}
+	values := metricValues(response)
+	for _, metric := range deltaMetrics {
+		if fields.Has(metric) {
+			c.Values[metric] = values[metric]
+		}
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// counterDay identifies the day the day timeframe currently reports, which
+// is the previous one within RESET_GRACE_SECONDS.
+func counterDay(config *Config) string {
+	start, _, _ := calculateRange(config, "day")
+	return start.Format(time.RFC3339)
+}
+
+// parseCursor decodes a ?since= cursor.
+func parseCursor(since string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(since)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return cursor{}, fmt.Errorf("invalid since cursor")
+	}
+	return c, nil
+}
+
+// deltaSince computes the Delta of response against a previous cursor.
+// Metrics missing from the cursor are reported in full.
+func deltaSince(config *Config, response Response, fields fieldSet, previous cursor) *Delta {
+	now := config.now()
+	newDay := previous.Day != counterDay(config)
+	delta := &Delta{
+		Values:  make(map[string]float64),
+		Seconds: now.Unix() - previous.Time,
+		Reset:   newDay,
+	}
+	values := metricValues(response)
+	for _, metric := range deltaMetrics {
+		if !fields.Has(metric) {
+			continue
+		}
+		before, ok := previous.Values[metric]
+		if newDay || !ok {
+			delta.Values[metric] = values[metric]
+			continue
+		}
+		if values[metric] < before {
+			// The counter went backwards, so it restarted
+			delta.Reset = true
+			delta.Values[metric] = values[metric]
+			continue
+		}
+		delta.Values[metric] = values[metric] - before
+	}
+	return delta
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"time"
+)
+
+// Demo mode serves synthetic data instead of querying InfluxDB. Each local
+// day gets a deterministic weather factor and load derived from its date, and
+// energy accrues along a sunrise-to-sunset curve (generation) or evenly
+// (household load), so values move with the time of day and the timeframe.
+// The flows are built so that
+//
+//	generated = selfUsed + charged + exported
+//	consumed  = selfUsed + discharged + imported
+//
+// holds for every window.
+
+const (
+	demoSunrise      = 6.0  // Local hour
+	demoSunset       = 18.0 // Local hour
+	demoPeakGenKWh   = 30.0 // Generation on a perfectly clear day
+	demoPeakPowerKW  = 7.5
+	demoBatteryKWh   = 10.0
+	demoDaytimeShare = 0.45 // Share of the load that falls in daylight
+)
+
+// demoDay holds one day's energy flows in kWh.
+type demoDay struct {
+	weather    float64 // 0.4 (overcast) to 1 (clear)
+	selfUsed   float64 // Generation consumed directly
+	charged    float64
+	exported   float64
+	discharged float64
+	imported   float64
+}
+
+func demoRandom(seed string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	return float64(h.Sum64()%10000) / 10000
+}
+
+func newDemoDay(config *Config, date string) demoDay {
+	weather := 0.4 + 0.6*demoRandom(config.Dongle+date+"weather")
+	generated := demoPeakGenKWh * weather
+	consumed := 22 + 6*demoRandom(config.Dongle+date+"load")
+
+	d := demoDay{weather: weather}
+	d.selfUsed = math.Min(generated, consumed*demoDaytimeShare)
+	surplus := generated - d.selfUsed
+	d.charged = math.Min(surplus, demoBatteryKWh)
+	d.exported = surplus - d.charged
+
+	nightLoad := consumed - d.selfUsed
+	d.discharged = math.Min(d.charged*0.9, nightLoad)
+	d.imported = nightLoad - d.discharged
+	return d
+}
+
+// demoSolarFraction is the share of a day's generation produced by local
+// hour h.
+func demoSolarFraction(h float64) float64 {
+	switch {
+	case h <= demoSunrise:
+		return 0
+	case h >= demoSunset:
+		return 1
+	default:
+		return (1 - math.Cos(math.Pi*(h-demoSunrise)/(demoSunset-demoSunrise))) / 2
+	}
+}
+
+// demoPowerFraction is the highest share of peak power reached between
+// local hours a and b.
+func demoPowerFraction(a, b float64) float64 {
+	a = math.Max(a, demoSunrise)
+	b = math.Min(b, demoSunset)
+	if a >= b {
+		return 0
+	}
+
+	noon := (demoSunrise + demoSunset) / 2
+	if a <= noon && b >= noon {
+		return 1
+	}
+	curve := func(h float64) float64 {
+		return math.Sin(math.Pi * (h - demoSunrise) / (demoSunset - demoSunrise))
+	}
+	return math.Max(curve(a), curve(b))
+}
+
+// demoMetricRange computes a metric over [start, stop) from the synthetic
+// days it overlaps. A zero stop runs up to now.
+func demoMetricRange(config *Config, metric string, start, stop time.Time) float64 {
+	if now := config.now(); stop.IsZero() || stop.After(now) {
+		stop = now
+	}
+
+	var total float64
+	start, stop = start.In(time.Local), stop.In(time.Local)
+	for day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.Local); day.Before(stop); day = day.AddDate(0, 0, 1) {
+		next := day.AddDate(0, 0, 1)
+		from := math.Max(start.Sub(day).Hours(), 0)
+		to := math.Min(stop.Sub(day).Hours(), next.Sub(day).Hours())
+		if from >= to {
+			continue
+		}
+
+		d := newDemoDay(config, day.Format(time.DateOnly))
+		solar := demoSolarFraction(to) - demoSolarFraction(from)
+		load := (to - from) / 24
+
+		switch metric {
+		case MetricGenerated:
+			total += (d.selfUsed + d.charged + d.exported) * solar
+		case MetricConsumed:
+			total += d.selfUsed*solar + (d.discharged+d.imported)*load
+		case MetricExported:
+			total += d.exported * solar
+		case MetricImported:
+			total += d.imported * load
+		case MetricDischarged:
+			total += d.discharged * load
+		case MetricCharged:
+			total += d.charged * solar
+		case MetricMaxPv:
+			total = math.Max(total, demoPeakPowerKW*d.weather*demoPowerFraction(from, to))
+		}
+	}
+
+	return total
+}
+
+// demoHourlyDeltas is the demo counterpart of queryMetricHourlyDeltas.
+func demoHourlyDeltas(config *Config, metric string, start, stop time.Time) map[time.Time]float64 {
+	if now := config.now(); stop.IsZero() || stop.After(now) {
+		stop = now
+	}
+
+	deltas := make(map[time.Time]float64)
+	for hour := start.Truncate(time.Hour); hour.Before(stop); hour = hour.Add(time.Hour) {
+		from, to := hour, hour.Add(time.Hour)
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(stop) {
+			to = stop
+		}
+		deltas[hour] = demoMetricRange(config, metric, from, to)
+	}
+	return deltas
+}
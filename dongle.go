@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// errUnknownDongle reports, with STRICT_DONGLE, a dongle that has never
+// written to the bucket.
+var errUnknownDongle = errors.New("unknown dongle")
+
+// knownDongles remembers the dongles already found, keyed by server,
+// bucket and tag value, so the existence check runs once per dongle.
+var knownDongles sync.Map
+
+// checkDongle returns errUnknownDongle when config.Dongle has no data under
+// TagKey anywhere in the bucket.
+func checkDongle(ctx context.Context, client influxdb2.Client, config *Config) error {
+	key := config.InfluxDBURL + "\x00" + config.InfluxDBBucket + "\x00" + config.TagKey + "\x00" + config.Dongle
+	if _, ok := knownDongles.Load(key); ok {
+		return nil
+	}
+
+	query := fmt.Sprintf(`
+		import "influxdata/influxdb/schema"
+
+		schema.tagValues(bucket: "%[1]s", tag: "%[2]s", predicate: (r) => r["%[2]s"] == "%[3]s", start: time(v: 0))`,
+		config.InfluxDBBucket,
+		config.TagKey,
+		config.Dongle)
+
+	if err := acquireQuerySlot(ctx); err != nil {
+		return fmt.Errorf("waiting to check dongle: %w", err)
+	}
+	defer releaseQuerySlot()
+	defer observeQuery(ctx, config, "dongle check", time.Now())
+
+	result, err := client.QueryAPI(config.InfluxDBOrg).Query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("checking dongle %s: %w", config.Dongle, err)
+	}
+	defer result.Close()
+
+	found := false
+	for result.Next() {
+		found = found || result.Record().Value() == config.Dongle
+	}
+	if err := result.Err(); err != nil {
+		return fmt.Errorf("checking dongle %s: %w", config.Dongle, err)
+	}
+	if !found {
+		return fmt.Errorf("%w %q: no %s tag with that value in bucket %s", errUnknownDongle, config.Dongle, config.TagKey, config.InfluxDBBucket)
+	}
+
+	knownDongles.Store(key, true)
+	return nil
+}
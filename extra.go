@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// ExtraMeasurement is an additional measurement surfaced under
+// Response.Extra[Key], reduced over the timeframe with a Flux aggregate.
+// An Optional one whose query fails is reported as 0 instead of failing
+// the request.
+type ExtraMeasurement struct {
+	Key         string
+	Measurement string
+	Aggregation string
+	Optional    bool
+}
+
+// extraAggregations are the Flux selectors and aggregates allowed for extra
+// measurements; each yields a single float per series.
+var extraAggregations = map[string]bool{
+	"max": true, "min": true, "mean": true, "sum": true, "first": true, "last": true,
+}
+
+var extraKeyPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// parseExtraMeasurements parses EXTRA_MEASUREMENTS, a comma-separated list
+// of "key=measurement:aggregation" entries such as
+// "gridVoltage=lux_VacR:last,gridFrequency=lux_Fac:mean". A trailing
+// ":optional" marks an entry optional.
+func parseExtraMeasurements(spec string) ([]ExtraMeasurement, error) {
+	var extras []ExtraMeasurement
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		key, source, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid extra measurement %q: expected key=measurement:aggregation", entry)
+		}
+		measurement, aggregation, ok := strings.Cut(source, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid extra measurement %q: expected key=measurement:aggregation", entry)
+		}
+		aggregation, optional := strings.CutSuffix(aggregation, ":optional")
+
+		if !extraKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid extra measurement %q: key must be alphanumeric", entry)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("invalid extra measurement %q: duplicate key", entry)
+		}
+		if measurement == "" || strings.ContainsAny(measurement, `"\`) {
+			return nil, fmt.Errorf("invalid extra measurement %q: bad measurement name", entry)
+		}
+		if !extraAggregations[aggregation] {
+			return nil, fmt.Errorf("invalid extra measurement %q: unsupported aggregation %q", entry, aggregation)
+		}
+
+		seen[key] = true
+		extras = append(extras, ExtraMeasurement{Key: key, Measurement: measurement, Aggregation: aggregation, Optional: optional})
+	}
+
+	return extras, nil
+}
+
+// extraQuery returns a metricQuery for an extra measurement.
+func extraQuery(extra ExtraMeasurement) metricQuery {
+	return func(ctx context.Context, client influxdb2.Client, config *Config, timeframe string) (float64, error) {
+		start, stop, err := calculateRange(config, timeframe)
+		if err != nil {
+			return 0, err
+		}
+
+		return queryAggregate(ctx, client, config, extra.Measurement, extra.Aggregation, start, stop)
+	}
+}
+
+// combineExtra merges one extra value across backends: sums add, extremes
+// keep the extreme, and everything else is averaged.
+func combineExtra(aggregation string, values []float64) float64 {
+	result := values[0]
+	for _, v := range values[1:] {
+		switch aggregation {
+		case "sum":
+			result += v
+		case "max":
+			result = max(result, v)
+		case "min":
+			result = min(result, v)
+		default:
+			result += v
+		}
+	}
+
+	switch aggregation {
+	case "sum", "max", "min":
+		return result
+	default:
+		return result / float64(len(values))
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// fieldSet is the set of Response fields a request asked for with
+// ?fields=. A nil set means every field.
+type fieldSet map[string]bool
+
+// selectableFields are the Response keys ?fields= can name.
+var selectableFields = []string{
+	MetricGenerated, MetricConsumed, MetricExported, MetricImported, MetricDischarged, MetricMaxPv,
+	"surplus", "gridIndependencePct", "gridDependencePct", "batteryRoundTripPct", "projectedDailyGenerated", "expectedGenerated", "performanceRatioPct", "estimatedSavings", "estimatedRuntimeMinutes", "extra",
+}
+
+func (f fieldSet) Has(name string) bool {
+	return f == nil || f[name]
+}
+
+// key returns a canonical form of the set for use in cache keys.
+func (f fieldSet) key() string {
+	if f == nil {
+		return ""
+	}
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ",")
+}
+
+// parseFields parses the comma-separated ?fields= parameter. An empty
+// parameter selects every field.
+func parseFields(param string) (fieldSet, error) {
+	if param == "" {
+		return nil, nil
+	}
+
+	fields := make(fieldSet)
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if !slices.Contains(selectableFields, name) {
+			return nil, fmt.Errorf("unknown field %q, expected one of %s", name, strings.Join(selectableFields, ", "))
+		}
+		fields[name] = true
+	}
+	return fields, nil
+}
+
+// renamableFields are the Response keys FIELD_NAMES can remap.
+var renamableFields = append(slices.Clone(selectableFields),
+	"formatted", "raw", "comparison", "energyUnit", "estimatedSavingsFormatted", "missing", "warnings", "stale", "queryDurationMs",
+	"dailyAverage", "counts", "profile", "delta", "cursor", "partial", "lastReading", "dataStale", "resetGrace", "slowQueries",
+)
+
+// parseFieldNames parses FIELD_NAMES, a comma-separated list of
+// "field=name" entries such as "generated=pv_generated,exported=grid_export".
+func parseFieldNames(spec string) (map[string]string, error) {
+	names := make(map[string]string)
+	taken := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		field, name, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid FIELD_NAMES entry %q: expected field=name", entry)
+		}
+		if !slices.Contains(renamableFields, field) {
+			return nil, fmt.Errorf("invalid FIELD_NAMES entry %q: unknown field %q", entry, field)
+		}
+		if _, ok := names[field]; ok {
+			return nil, fmt.Errorf("invalid FIELD_NAMES entry %q: %s is renamed twice", entry, field)
+		}
+		if taken[name] {
+			return nil, fmt.Errorf("invalid FIELD_NAMES entry %q: %s is used twice", entry, name)
+		}
+		names[field] = name
+		taken[name] = true
+	}
+
+	// A new name may only reuse an existing key if that key moves away too
+	for field, name := range names {
+		if _, moved := names[name]; slices.Contains(renamableFields, name) && !moved {
+			return nil, fmt.Errorf("invalid FIELD_NAMES entry %s=%s: %s is already a field", field, name, name)
+		}
+	}
+
+	return names, nil
+}
+
+// numericFields are the Response keys NUMBER_TYPES can type; "extra"
+// covers every extra value.
+var numericFields = []string{
+	MetricGenerated, MetricConsumed, MetricExported, MetricImported, MetricDischarged, MetricMaxPv,
+	"surplus", "estimatedSavings", "estimatedRuntimeMinutes", "queryDurationMs", "extra",
+	"gridIndependencePct", "gridDependencePct", "batteryRoundTripPct", "projectedDailyGenerated",
+	"expectedGenerated", "performanceRatioPct",
+}
+
+// parseNumberTypes parses NUMBER_TYPES, a comma-separated list of
+// "field=int" or "field=float" entries.
+func parseNumberTypes(spec string) (map[string]string, error) {
+	types := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		field, kind, _ := strings.Cut(entry, "=")
+		if !slices.Contains(numericFields, field) {
+			return nil, fmt.Errorf("invalid NUMBER_TYPES entry %q: unknown field %q", entry, field)
+		}
+		if kind != "int" && kind != "float" {
+			return nil, fmt.Errorf("invalid NUMBER_TYPES entry %q: expected int or float", entry)
+		}
+		types[field] = kind
+	}
+	return types, nil
+}
+
+// valueKinds classifies the numeric Response keys for DECIMAL_PLACES,
+// including those nested in comparison and dailyAverage.
+var valueKinds = map[string]string{
+	MetricGenerated:           "energy",
+	MetricConsumed:            "energy",
+	MetricExported:            "energy",
+	MetricImported:            "energy",
+	MetricDischarged:          "energy",
+	"surplus":                 "energy",
+	"batteryRoundTripPct":     "percent",
+	"projectedDailyGenerated": "energy",
+	"expectedGenerated":       "energy",
+	"performanceRatioPct":     "percent",
+	MetricMaxPv:               "power",
+	"gridIndependencePct":     "percent",
+	"gridDependencePct":       "percent",
+}
+
+// parseDecimalPlaces parses DECIMAL_PLACES, a comma-separated list of
+// "kind=places" entries such as "energy=2,power=1,percent=0".
+func parseDecimalPlaces(spec string) (map[string]int, error) {
+	places := make(map[string]int)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		kind, v, _ := strings.Cut(entry, "=")
+		if kind != "energy" && kind != "power" && kind != "percent" {
+			return nil, fmt.Errorf("invalid DECIMAL_PLACES entry %q: expected energy, power or percent", entry)
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid DECIMAL_PLACES entry %q: expected a number of places", entry)
+		}
+		places[kind] = n
+	}
+	return places, nil
+}
+
+// roundValue rounds v to the DECIMAL_PLACES of kind, if any.
+func roundValue(config *Config, kind string, v float64) float64 {
+	places, ok := config.DecimalPlaces[kind]
+	if !ok {
+		return v
+	}
+	scale := math.Pow10(places)
+	return math.Round(v*scale) / scale
+}
+
+// roundValues applies DECIMAL_PLACES to the numbers in m, classifying each
+// by kind, or by its key when kind is empty.
+func roundValues(config *Config, m map[string]any, kind string) {
+	for key, value := range m {
+		k := kind
+		if k == "" {
+			k = valueKinds[key]
+		}
+		if f, ok := value.(float64); ok {
+			m[key] = roundValue(config, k, f)
+		}
+	}
+}
+
+// typedNumber renders v as the given NUMBER_TYPES kind: ints are rounded,
+// and floats always carry a decimal point, which encoding/json drops for
+// whole values.
+func typedNumber(v float64, kind string) json.Number {
+	if kind == "int" {
+		return json.Number(strconv.FormatFloat(math.Round(v), 'f', 0, 64))
+	}
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return json.Number(s)
+}
+
+// encodeResponse shapes a Response for the client: it drops the selectable
+// fields that weren't asked for, leaving metadata such as energyUnit and
+// warnings intact, and applies DECIMAL_PLACES, OMIT_ZEROS, NUMBER_TYPES and
+// FIELD_NAMES.
+func encodeResponse(config *Config, response Response, fields fieldSet) (any, error) {
+	if fields == nil && len(config.FieldNames) == 0 && len(config.NumberTypes) == 0 && len(config.DecimalPlaces) == 0 && len(response.unresolved) == 0 && !config.OmitZeros {
+		return response, nil
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+
+	formatted, _ := body["formatted"].(map[string]any)
+	for _, name := range selectableFields {
+		if fields.Has(name) {
+			continue
+		}
+		delete(body, name)
+		delete(formatted, name)
+		if name == "estimatedSavings" {
+			delete(body, "estimatedSavingsFormatted")
+		}
+	}
+
+	extra, _ := body["extra"].(map[string]any)
+	for _, name := range response.unresolved {
+		if key, ok := strings.CutPrefix(name, "extra."); ok && extra != nil {
+			extra[key] = nil
+			continue
+		}
+		if !slices.Contains(selectableFields, name) || !fields.Has(name) {
+			continue
+		}
+		body[name] = nil
+		if _, ok := formatted[name]; ok {
+			formatted[name] = nil
+		}
+		if name == "estimatedSavings" {
+			body["estimatedSavingsFormatted"] = nil
+		}
+	}
+
+	if len(config.DecimalPlaces) > 0 {
+		roundValues(config, body, "")
+		if comparison, ok := body["comparison"].(map[string]any); ok {
+			previous, _ := comparison["previous"].(map[string]any)
+			roundValues(config, previous, "")
+			changePct, _ := comparison["changePct"].(map[string]any)
+			roundValues(config, changePct, "percent")
+		}
+		if average, ok := body["dailyAverage"].(map[string]any); ok {
+			total, _ := average["total"].(map[string]any)
+			roundValues(config, total, "energy")
+			perDay, _ := average["average"].(map[string]any)
+			roundValues(config, perDay, "energy")
+		}
+	}
+
+	if config.OmitZeros {
+		// After rounding, so values that round to zero go too
+		for _, name := range selectableFields {
+			if v, ok := body[name].(float64); ok && v == 0 {
+				delete(body, name)
+				delete(formatted, name)
+			}
+		}
+		for key, value := range extra {
+			if v, ok := value.(float64); ok && v == 0 {
+				delete(extra, key)
+			}
+		}
+	}
+
+	for field, kind := range config.NumberTypes {
+		switch v := body[field].(type) {
+		case float64:
+			body[field] = typedNumber(v, kind)
+		case map[string]any:
+			for key, value := range v {
+				if f, ok := value.(float64); ok {
+					v[key] = typedNumber(f, kind)
+				}
+			}
+		}
+	}
+
+	rename := func(m map[string]any) map[string]any {
+		if len(config.FieldNames) == 0 || m == nil {
+			return m
+		}
+		renamed := make(map[string]any, len(m))
+		for key, value := range m {
+			if name, ok := config.FieldNames[key]; ok {
+				key = name
+			}
+			renamed[key] = value
+		}
+		return renamed
+	}
+	if formatted != nil {
+		body["formatted"] = rename(formatted)
+	}
+
+	return rename(body), nil
+}
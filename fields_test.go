@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNumericFieldsCoverValueKinds(t *testing.T) {
+	for key := range valueKinds {
+		if !slices.Contains(numericFields, key) {
+			t.Errorf("%s has a value kind but NUMBER_TYPES can't type it", key)
+		}
+	}
+}
+
+func TestNumberTypesPercentages(t *testing.T) {
+	types, err := parseNumberTypes("gridIndependencePct=float,batteryRoundTripPct=int")
+	if err != nil {
+		t.Fatal(err)
+	}
+	independence, roundTrip := 64.0, 91.6
+	config := &Config{NumberTypes: types}
+	body, err := encodeResponse(config, Response{GridIndependencePct: &independence, BatteryRoundTripPct: &roundTrip}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"gridIndependencePct":64.0`, `"batteryRoundTripPct":92`} {
+		if !strings.Contains(string(encoded), want) {
+			t.Errorf("%s does not contain %s", encoded, want)
+		}
+	}
+}
+
+func TestRenamableFieldsCoverResponse(t *testing.T) {
+	response := reflect.TypeFor[Response]()
+	for i := range response.NumField() {
+		field := response.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "error" || name == "errorCode" {
+			// Error bodies aren't renamed
+			continue
+		}
+		if !slices.Contains(renamableFields, name) {
+			t.Errorf("FIELD_NAMES can't rename %s", name)
+		}
+	}
+}
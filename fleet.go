@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+type FleetResponse struct {
+	Timeframe  string  `json:"timeframe"`
+	EnergyUnit string  `json:"energyUnit"`
+	Generated  float64 `json:"generated"`
+	Consumed   float64 `json:"consumed"`
+	// Participants counts the dongles included in the totals.
+	Participants int `json:"participants"`
+	// Failures lists the dongles left out because their query failed.
+	Failures []FleetFailure `json:"failures,omitempty"`
+}
+
+type FleetFailure struct {
+	Dongle    string `json:"dongle"`
+	Error     string `json:"error"`
+	ErrorCode string `json:"errorCode"`
+}
+
+// errPartial reports a backend whose queries were still running at
+// SOFT_DEADLINE, so its Response is missing values.
+var errPartial = errors.New("queries did not finish within SOFT_DEADLINE")
+
+// queryFleet sums generated and consumed across every backend. Unlike
+// fanOut, a failing backend doesn't cancel the others: it is reported in
+// Failures and the totals cover the rest, as is one left partial by
+// SOFT_DEADLINE. The error is the first failure, returned only when every
+// backend failed.
+func queryFleet(ctx context.Context, backends []backend, config *Config, timeframe string) (FleetResponse, error) {
+	if config.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.QueryTimeout)
+		defer cancel()
+	}
+
+	fields := fieldSet{MetricGenerated: true, MetricConsumed: true}
+	responses := make([]Response, len(backends))
+	errs := make([]error, len(backends))
+
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], errs[i] = queryResponse(ctx, b.client, b.config, timeframe, fields)
+			if errs[i] == nil && responses[i].Partial {
+				errs[i] = errPartial
+			}
+		}()
+	}
+	wg.Wait()
+
+	fleet := FleetResponse{Timeframe: timeframe, EnergyUnit: config.EnergyUnit}
+	for i, b := range backends {
+		if errs[i] != nil {
+			logf(ctx, "fleet: %s failed: %v", b.config.Dongle, errs[i])
+			fleet.Failures = append(fleet.Failures, FleetFailure{
+				Dongle:    b.config.Dongle,
+				Error:     errs[i].Error(),
+				ErrorCode: errorCode(errs[i]),
+			})
+			continue
+		}
+		fleet.Generated += responses[i].Generated
+		fleet.Consumed += responses[i].Consumed
+		fleet.Participants++
+	}
+	if fleet.Participants == 0 {
+		return FleetResponse{}, errs[0]
+	}
+	return fleet, nil
+}
+
+// handleFleet serves the combined generation and consumption of every
+// configured dongle for a timeframe. It answers 200 while any dongle is
+// reachable, listing the failed ones, and fails only when all of them do.
+func handleFleet(backends []backend, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		timeframe, ok := queryTimeframe(w, r, config)
+		if !ok {
+			return
+		}
+
+		fleet, err := queryFleet(r.Context(), backends, config, timeframe)
+		if err != nil {
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error(), ErrorCode: errorCode(err)})
+			return
+		}
+		if len(fleet.Failures) > 0 {
+			// Don't let caches keep an incomplete total
+			w.Header().Set("Cache-Control", "no-store")
+		}
+
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Type", "application/json")
+			return
+		}
+		writeJSON(w, http.StatusOK, fleet)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueryFleetPartialIsFailure(t *testing.T) {
+	answer := func(query string) string {
+		return ",,0,2024-01-01T00:00:00Z,2024-01-02T00:00:00Z,4.5,lux_Epv1_day"
+	}
+	slow := func(query string) string {
+		time.Sleep(200 * time.Millisecond)
+		return answer(query)
+	}
+
+	config := testConfig()
+	config.SoftDeadline = 50 * time.Millisecond
+	other := testConfig()
+	other.Dongle, other.SoftDeadline = "BB87654321", config.SoftDeadline
+	backends := []backend{{fakeInfluxDB(t, answer), config}, {fakeInfluxDB(t, slow), other}}
+
+	fleet, err := queryFleet(context.Background(), backends, config, "day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fleet.Participants != 1 || len(fleet.Failures) != 1 {
+		t.Fatalf("participants = %d, failures = %+v, want 1 of each", fleet.Participants, fleet.Failures)
+	}
+	if got := fleet.Failures[0]; got.Dongle != "BB87654321" || got.Error != errPartial.Error() {
+		t.Errorf("failure = %+v, want BB87654321 with %q", got, errPartial)
+	}
+	if fleet.Generated != 13.5 {
+		t.Errorf("generated = %v, want 13.5 from BA12345678 only", fleet.Generated)
+	}
+}
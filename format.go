@@ -0,0 +1,31 @@
+package main
+
+import "fmt"
+
+// FormattedResponse mirrors the numeric Response fields as display strings
+// with units, e.g. "12.3 kWh".
+type FormattedResponse struct {
+	Generated  string `json:"generated"`
+	Consumed   string `json:"consumed"`
+	Exported   string `json:"exported"`
+	Imported   string `json:"imported"`
+	Discharged string `json:"discharged"`
+	MaxPv      string `json:"maxPv"`
+	Surplus    string `json:"surplus"`
+}
+
+func formatQuantity(config *Config, value float64, unit string) string {
+	return fmt.Sprintf("%.*f %s", config.FormatDecimals, value, unit)
+}
+
+func formatResponse(config *Config, response Response) *FormattedResponse {
+	return &FormattedResponse{
+		Generated:  formatQuantity(config, response.Generated, config.EnergyUnit),
+		Consumed:   formatQuantity(config, response.Consumed, config.EnergyUnit),
+		Exported:   formatQuantity(config, response.Exported, config.EnergyUnit),
+		Imported:   formatQuantity(config, response.Imported, config.EnergyUnit),
+		Discharged: formatQuantity(config, response.Discharged, config.EnergyUnit),
+		MaxPv:      formatQuantity(config, response.MaxPv, "kW"),
+		Surplus:    formatQuantity(config, response.Surplus, config.EnergyUnit),
+	}
+}
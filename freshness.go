@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// queryLastReading returns the time of the newest point of any configured
+// metric within the last MAX_DATA_AGE, or the zero time if there is none.
+func queryLastReading(ctx context.Context, client influxdb2.Client, config *Config) (time.Time, error) {
+	now := config.now()
+	stop := zeroTime
+	if config.Clock != nil {
+		stop = now.UTC()
+	}
+
+	query := fmt.Sprintf(`
+		from(bucket:"%[1]s")
+			|> range(%[2]s)
+			|> %[3]s
+			|> filter(fn: (r) => r["%[5]s"] == "%[4]s")
+			|> group()
+			|> last()`,
+		config.InfluxDBBucket,
+		fluxRange(now.Add(-config.MaxDataAge).UTC(), stop),
+		seriesFilter(config, configuredMeasurements(config)...),
+		config.Dongle,
+		config.TagKey)
+
+	if err := acquireQuerySlot(ctx); err != nil {
+		return time.Time{}, fmt.Errorf("waiting to query the last reading: %w", err)
+	}
+	defer releaseQuerySlot()
+	defer observeQuery(ctx, config, "last reading", time.Now())
+
+	result, err := client.QueryAPI(config.InfluxDBOrg).Query(ctx, query)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("query failed for the last reading: %w", err)
+	}
+	defer result.Close()
+
+	var last time.Time
+	for result.Next() {
+		if t := result.Record().Time(); t.After(last) {
+			last = t
+		}
+	}
+	if err := result.Err(); err != nil {
+		return time.Time{}, fmt.Errorf("reading result for the last reading: %w", err)
+	}
+	return last, nil
+}
+
+// checkFreshness sets Response.LastReading and DataStale from every
+// backend. The oldest backend's last reading is reported, and a backend
+// with nothing within MAX_DATA_AGE marks the response stale. Demo data is
+// always fresh.
+func checkFreshness(ctx context.Context, backends []backend, config *Config, response *Response) error {
+	if config.DemoMode {
+		now := config.responseTime(config.now())
+		response.LastReading = &now
+		return nil
+	}
+
+	readings := make([]time.Time, len(backends))
+	err := fanOut(ctx, backends, func(ctx context.Context, i int, b backend) error {
+		var err error
+		readings[i], err = queryLastReading(ctx, b.client, b.config)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var oldest time.Time
+	for _, t := range readings {
+		if t.IsZero() {
+			response.DataStale = true
+		} else if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	if !oldest.IsZero() {
+		oldest = config.responseTime(oldest)
+		response.LastReading = &oldest
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import "slices"
+
+// HassSensor is one metric in the shape of a Home Assistant sensor, so each
+// RESTful sensor can read its state and attributes without a template.
+type HassSensor struct {
+	State             float64 `json:"state"`
+	UnitOfMeasurement string  `json:"unit_of_measurement"`
+	DeviceClass       string  `json:"device_class"`
+	StateClass        string  `json:"state_class"`
+}
+
+// hassResponse renders the requested metrics of response as HassSensors,
+// keyed by their FIELD_NAMES names.
+func hassResponse(config *Config, timeframe string, response Response, fields fieldSet) map[string]HassSensor {
+	// Windows starting at a reset only grow; the trailing ones also shrink
+	// as old days drop out
+	energyClass := "total"
+	if timeframe == "day" || timeframe == "isoweek" {
+		energyClass = "total_increasing"
+	}
+
+	sensors := make(map[string]HassSensor)
+	for name, value := range metricValues(response) {
+		if !fields.Has(name) || slices.Contains(response.unresolved, name) {
+			continue
+		}
+		value = roundValue(config, valueKinds[name], value)
+		sensor := HassSensor{State: value, UnitOfMeasurement: config.EnergyUnit, DeviceClass: "energy", StateClass: energyClass}
+		switch name {
+		case MetricMaxPv:
+			sensor = HassSensor{State: value, UnitOfMeasurement: "kW", DeviceClass: "power", StateClass: "measurement"}
+		case "surplus":
+			// Negative on a deficit, so never total_increasing
+			sensor.StateClass = "total"
+		}
+		if renamed, ok := config.FieldNames[name]; ok {
+			name = renamed
+		}
+		sensors[name] = sensor
+	}
+	return sensors
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// readyTimeout bounds the InfluxDB ping behind /readyz so a hung backend
+// fails the probe instead of stalling it.
+const readyTimeout = 2 * time.Second
+
+type HealthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleLivez reports that the process is up and serving HTTP. It never
+// touches InfluxDB, so backend outages don't trigger restarts.
+func handleLivez() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+	}
+}
+
+// pingBackends checks that every InfluxDB backend answers a ping.
+func pingBackends(ctx context.Context, backends []backend) error {
+	return fanOut(ctx, backends, func(ctx context.Context, i int, b backend) error {
+		ok, err := b.client.Ping(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", b.config.InfluxDBURL, err)
+		}
+		if !ok {
+			return fmt.Errorf("%s: InfluxDB ping failed", b.config.InfluxDBURL)
+		}
+		return nil
+	})
+}
+
+// warmupInterval is how often InfluxDB is pinged until it first answers,
+// and the Retry-After sent to requests in the meantime.
+const warmupInterval = 2 * time.Second
+
+// warmup tracks whether InfluxDB has answered since startup.
+type warmup struct {
+	ready atomic.Bool
+}
+
+// startWarmup pings the backends in the background until they all answer
+// once. Demo mode needs no InfluxDB and starts ready.
+func startWarmup(backends []backend, config *Config) *warmup {
+	wu := &warmup{}
+	if config.DemoMode {
+		wu.ready.Store(true)
+		return wu
+	}
+
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+			err := pingBackends(ctx, backends)
+			cancel()
+			if err == nil {
+				log.Printf("InfluxDB is reachable, warmup complete")
+				wu.ready.Store(true)
+				return
+			}
+			log.Printf("Waiting for InfluxDB: %v", err)
+			time.Sleep(warmupInterval)
+		}
+	}()
+	return wu
+}
+
+// requireWarm answers 503 with Retry-After until InfluxDB has answered
+// once, so requests racing a slow InfluxDB start aren't reported as
+// failures.
+func requireWarm(wu *warmup, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !wu.ready.Load() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(warmupInterval.Seconds())))
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{
+				Error:     "waiting for InfluxDB to become reachable",
+				ErrorCode: ErrorCodeBackendUnavailable,
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleReadyz reports whether every InfluxDB backend is reachable and real
+// data can be served.
+func handleReadyz(backends []backend, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.DemoMode {
+			writeJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		if err := pingBackends(ctx, backends); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, HealthResponse{Status: "unavailable", Error: err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// leaderboardMetrics maps the ?by= values to the Response value each ranks
+// by. Self-sufficiency is gridIndependencePct, nil without consumption.
+var leaderboardMetrics = map[string]func(Response) *float64{
+	"generated":       func(r Response) *float64 { return &r.Generated },
+	"selfSufficiency": func(r Response) *float64 { return r.GridIndependencePct },
+}
+
+type LeaderboardResponse struct {
+	Timeframe string             `json:"timeframe"`
+	By        string             `json:"by"`
+	Entries   []LeaderboardEntry `json:"entries"`
+}
+
+// LeaderboardEntry is one dongle's standing. Value and Gap, how far it
+// trails first place, are nil when the dongle has no value to rank by,
+// including when Partial, its queries still running at SOFT_DEADLINE.
+type LeaderboardEntry struct {
+	Rank                int      `json:"rank"`
+	Dongle              string   `json:"dongle"`
+	Value               *float64 `json:"value"`
+	Gap                 *float64 `json:"gap"`
+	Generated           float64  `json:"generated"`
+	GridIndependencePct *float64 `json:"gridIndependencePct,omitempty"`
+	Partial             bool     `json:"partial,omitempty"`
+}
+
+// rankLeaderboard sorts entries by Value, highest first, and ranks them.
+// Equal values share a rank, competition style (1, 1, 3), and are listed
+// by dongle name; entries without a value come last, unranked among
+// themselves.
+func rankLeaderboard(entries []LeaderboardEntry) {
+	slices.SortFunc(entries, func(a, b LeaderboardEntry) int {
+		if (a.Value == nil) != (b.Value == nil) {
+			if a.Value == nil {
+				return 1
+			}
+			return -1
+		}
+		if a.Value != nil && *a.Value != *b.Value {
+			return cmp.Compare(*b.Value, *a.Value)
+		}
+		return cmp.Compare(a.Dongle, b.Dongle)
+	})
+
+	for i := range entries {
+		e := &entries[i]
+		switch {
+		case i > 0 && (e.Value == nil && entries[i-1].Value == nil ||
+			e.Value != nil && entries[i-1].Value != nil && *e.Value == *entries[i-1].Value):
+			e.Rank = entries[i-1].Rank
+		default:
+			e.Rank = i + 1
+		}
+		if e.Value != nil && entries[0].Value != nil {
+			gap := *entries[0].Value - *e.Value
+			e.Gap = &gap
+		}
+	}
+}
+
+// handleLeaderboard ranks the configured dongles by a metric over a
+// timeframe, querying them concurrently.
+func handleLeaderboard(backends []backend, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		timeframe, ok := queryTimeframe(w, r, config)
+		if !ok {
+			return
+		}
+
+		by := r.URL.Query().Get("by")
+		if by == "" {
+			by = "generated"
+		}
+		value, ok := leaderboardMetrics[by]
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{
+				Error:     fmt.Sprintf("invalid by %q: expected generated or selfSufficiency", by),
+				ErrorCode: ErrorCodeInvalidParameter,
+			})
+			return
+		}
+
+		ctx := r.Context()
+		if config.QueryTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, config.QueryTimeout)
+			defer cancel()
+		}
+
+		fields := fieldSet{MetricGenerated: true, MetricConsumed: true, MetricImported: true, "gridIndependencePct": true}
+		entries := make([]LeaderboardEntry, len(backends))
+		err := fanOut(ctx, backends, func(ctx context.Context, i int, b backend) error {
+			response, err := queryResponse(ctx, b.client, b.config, timeframe, fields)
+			if err != nil {
+				return fmt.Errorf("%s: %w", b.config.Dongle, err)
+			}
+			entries[i] = LeaderboardEntry{
+				Dongle:              b.config.Dongle,
+				Value:               value(response),
+				Generated:           response.Generated,
+				GridIndependencePct: response.GridIndependencePct,
+			}
+			if response.Partial {
+				// Its zeroed values would rank among the real ones
+				entries[i].Value = nil
+				entries[i].Partial = true
+			}
+			return nil
+		})
+		if err != nil {
+			writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error(), ErrorCode: errorCode(err)})
+			return
+		}
+		rankLeaderboard(entries)
+		if slices.ContainsFunc(entries, func(e LeaderboardEntry) bool { return e.Partial }) {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Type", "application/json")
+			return
+		}
+		writeJSON(w, http.StatusOK, LeaderboardResponse{Timeframe: timeframe, By: by, Entries: entries})
+	}
+}
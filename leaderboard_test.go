@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLeaderboardPartialRanksLast(t *testing.T) {
+	answer := func(string) string {
+		return ",,0,2024-01-01T00:00:00Z,2024-01-02T00:00:00Z,1.5,lux_Epv1_day"
+	}
+	slow := func(query string) string {
+		time.Sleep(200 * time.Millisecond)
+		return answer(query)
+	}
+
+	config := testConfig()
+	config.SoftDeadline = 50 * time.Millisecond
+	other := testConfig()
+	other.Dongle, other.SoftDeadline = "AA87654321", config.SoftDeadline
+	backends := []backend{{fakeInfluxDB(t, answer), config}, {fakeInfluxDB(t, slow), other}}
+
+	rec := httptest.NewRecorder()
+	handleLeaderboard(backends, config)(rec, httptest.NewRequest("GET", "/leaderboard", nil))
+	var leaderboard LeaderboardResponse
+	if err := json.NewDecoder(rec.Body).Decode(&leaderboard); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leaderboard.Entries) != 2 {
+		t.Fatalf("entries = %+v, want 2", leaderboard.Entries)
+	}
+	first, last := leaderboard.Entries[0], leaderboard.Entries[1]
+	if first.Dongle != "BA12345678" || first.Rank != 1 || first.Value == nil || *first.Value != 4.5 {
+		t.Errorf("first = %+v, want BA12345678 ranked 1 with 4.5", first)
+	}
+	if last.Dongle != "AA87654321" || !last.Partial || last.Value != nil || last.Gap != nil {
+		t.Errorf("last = %+v, want AA87654321 partial without a value", last)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+}
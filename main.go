@@ -1,25 +1,262 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
 )
 
 type Config struct {
-	InfluxDBURL    string
-	InfluxDBToken  string
-	InfluxDBOrg    string
-	InfluxDBBucket string
-	ServerPort     string
-	Dongle         string
+	InfluxDBURL     string
+	InfluxDBToken   string
+	InfluxDBOrg     string
+	InfluxDBBucket  string
+	InfluxDBVersion string
+	ServerPort      string
+	// DayStartHour is the local hour the "day" window starts at, for
+	// billing days that don't start at midnight.
+	DayStartHour int
+	// ResetGrace serves the previous day as "day" for this long after the
+	// daily reset, while the counters settle.
+	ResetGrace time.Duration
+	// RangePrecision truncates the rolling week and month starts, which
+	// would otherwise carry the clock's seconds, so their queries and logs
+	// are stable within it. Zero keeps the exact time.
+	RangePrecision time.Duration
+
+	// UserAgent identifies this service in the User-Agent of its InfluxDB
+	// requests, after the client library's own.
+	UserAgent string
+	// ClientLogLevel is the InfluxDB client library's own log level, one
+	// of clientLogLevels or "none" to silence it.
+	ClientLogLevel string
+
+	// GzipLevel is the compress/gzip level for clients accepting gzip, from
+	// HuffmanOnly (-2) to BestCompression (9); NoCompression (0) disables
+	// compression.
+	GzipLevel int
+
+	// ServeUI serves the embedded dashboard at "/".
+	ServeUI bool
+	// BindAddress restricts the listener to one interface; empty listens
+	// on all of them.
+	BindAddress string
+
+	// Clock, when set, replaces the wall clock for timeframe math, and
+	// open-ended windows are closed at its time rather than InfluxDB's. Tests
+	// set it to freeze time; NOW pins it to replay a historical moment.
+	Clock func() time.Time `json:"-"`
+
+	// ResponseTZ is the zone timestamps in responses are written in,
+	// from RESPONSE_TZ; queries and timeframe math are unaffected.
+	ResponseTZ *time.Location `json:"-"`
+
+	// Series are selected by r[TagKey] == Dongle. TagKey defaults to
+	// "dongle" and Dongle comes from DONGLE or TAG_VALUE.
+	TagKey string
+	Dongle string
+
+	// MaxConcurrentQueries bounds the InfluxDB queries in flight across all
+	// requests; zero disables the limit.
+	MaxConcurrentQueries int
+
+	// AllowedTimeframes, when non-empty, is the only timeframes
+	// /solarshowdown serves; any other is rejected with 403. A ?month= counts
+	// as "month".
+	AllowedTimeframes []string
+
+	// DailyMaxDays caps the days parameter of the /daily endpoint.
+	DailyMaxDays int
+
+	// SunriseHour and SunsetHour bound the daylight that
+	// Response.ProjectedDailyGenerated extrapolates over, in local hours.
+	SunriseHour int
+	SunsetHour  int
+
+	// SystemCapacityKW, Latitude and Longitude describe the array for
+	// Response.ExpectedGenerated; the coordinates are nil when unset.
+	SystemCapacityKW float64
+	Latitude         *float64
+	Longitude        *float64
+
+	// A /streak day counts while its imports are at most
+	// StreakThresholdKWh; StreakMaxDays bounds how far back it looks.
+	StreakThresholdKWh float64
+	StreakMaxDays      int
+
+	// Savings are reported only when SavingsEnabled, i.e. IMPORT_RATE is
+	// set. Rates are in currency units per kWh.
+	SavingsEnabled   bool
+	ImportRate       float64
+	ExportRate       float64
+	CurrencySymbol   string
+	CurrencyDecimals int
+
+	// TariffWindows switches savings to time-of-use pricing when non-empty.
+	TariffWindows []TariffWindow
+
+	// ExtraMeasurements are queried alongside the fixed metrics.
+	ExtraMeasurements []ExtraMeasurement
+
+	// Metrics maps each Response metric to its source measurements.
+	Metrics map[string]MetricSource
+	// DongleOverrides replaces settings per dongle, applied to each
+	// backend's copy of the Config.
+	DongleOverrides map[string]DongleOverride
+
+	// MaxPvCapKW discards power readings above it from maxPv, as sensor
+	// glitches; zero disables the cap. valueCeiling is the raw-unit filter
+	// applied to the retried query.
+	MaxPvCapKW   float64
+	valueCeiling float64
+
+	// DailyCeilings are per-day kWh ceilings on counter metrics, scaled by
+	// the days a range touches; SanityAction is what exceeding one does.
+	DailyCeilings map[string]float64
+	SanityAction  string
+
+	// Downsampled overrides Metrics per timeframe, for long timeframes read
+	// from pre-aggregated measurements.
+	Downsampled map[string]map[string]MetricSource
+	// OmitZeros drops zero-valued numeric fields from responses.
+	OmitZeros bool
+	// AllowPost accepts POST /solarshowdown with its parameters in a JSON
+	// body, for proxies that strip query strings.
+	AllowPost bool
+	// FieldNames maps Response JSON keys to the names clients see.
+	FieldNames map[string]string
+	// DecimalPlaces rounds the numeric Response fields of each kind:
+	// "energy", "power" or "percent".
+	DecimalPlaces map[string]int
+	// NumberTypes forces numeric Response fields to render as "int" or
+	// "float".
+	NumberTypes map[string]string
+
+	// PivotedSchema stores every metric as a field of PivotedMeasurement
+	// rather than as its own measurement with a ValueField field.
+	PivotedSchema      bool
+	PivotedMeasurement string
+
+	// ValueField is the one field read from each measurement, so siblings
+	// such as "quality" never reach the aggregate. Defaults to "value".
+	ValueField string
+
+	// TrustProxy takes the client address from X-Forwarded-For entry
+	// TrustProxyIndex, counted from the left or, when negative, the right.
+	TrustProxy      bool
+	TrustProxyIndex int
+
+	// WebhookURL, when set, receives a POST of the WebhookTimeframe
+	// Response at every WebhookSchedule time.
+	WebhookURL       string
+	WebhookSchedule  *cronSchedule `json:"-"`
+	WebhookTimeframe string
+
+	// MinGenerationKWh zeroes generated and maxPv when generated is below
+	// it.
+	MinGenerationKWh float64
+
+	// CombinedQuery fetches the metrics with one Flux query instead of one
+	// per measurement.
+	CombinedQuery bool
+
+	// StrictDongle checks that the dongle exists in the bucket before
+	// querying, so a typo is a 404 rather than a day of zeros.
+	StrictDongle bool
+
+	// BatteryCapacityKWh enables Response.EstimatedRuntimeMinutes.
+	BatteryCapacityKWh float64
+
+	// ConsumptionMode selects how Response.Consumed is computed; see the
+	// Consumption* constants.
+	ConsumptionMode string
+
+	// PvPowerStrings, when set, computes maxPv as the peak of the summed
+	// per-string power measurements instead of from a total measurement.
+	PvPowerStrings []string
+
+	// EnergyUnit is "kWh" or "Wh" and applies to every energy field.
+	EnergyUnit string
+
+	// FormatDecimals is the precision of the ?formatted=true strings.
+	FormatDecimals int
+
+	// CacheTTL is how long /solarshowdown responses are reused; zero
+	// disables caching. CacheTTLs overrides it per timeframe.
+	CacheTTL  time.Duration
+	CacheTTLs map[string]time.Duration
+
+	// CacheControlMaxAge is the max-age sent on successful /solarshowdown
+	// responses. Without CACHE_CONTROL_MAX_AGE it follows CacheTTLs.
+	CacheControlMaxAge    time.Duration
+	CacheControlMaxAgeSet bool
+
+	// CacheMaxEntries bounds the response cache, evicting the least
+	// recently used entry; zero leaves it unbounded.
+	CacheMaxEntries int
+
+	// ServeStaleMaxAge enables falling back to a cached Response up to this
+	// old when the backend queries fail; zero disables the fallback.
+	ServeStaleMaxAge time.Duration
+
+	// QueryTimeout bounds the backend queries behind a single request; zero
+	// leaves them bounded only by the client connection.
+	QueryTimeout time.Duration
+
+	// LenientTypes reads numbers stored as strings instead of failing on
+	// them.
+	LenientTypes bool
+
+	// SoftDeadline, when shorter than QueryTimeout, bounds the queries
+	// behind one request; fields still unresolved by then are returned as
+	// null in a partial response. Zero disables it.
+	SoftDeadline time.Duration
+
+	// MaxDataAge, when set, checks each response for a reading this recent
+	// and flags Response.DataStale without one; StaleDataError also answers
+	// such responses with 503.
+	MaxDataAge     time.Duration
+	StaleDataError bool
+
+	// CoalesceQueries lets concurrent identical /solarshowdown requests
+	// share one set of InfluxDB queries; COALESCE_QUERIES=false disables it.
+	CoalesceQueries bool
+
+	// SlowQuery logs every InfluxDB query taking longer; zero disables it.
+	SlowQuery time.Duration
+	// RetryEmpty is how long to wait before retrying, once, a measurement
+	// query over a range reaching now that returned nothing; zero disables
+	// it.
+	RetryEmpty time.Duration
+
+	// DemoMode serves synthetic data without contacting InfluxDB.
+	DemoMode bool
+
+	// AdminToken guards the /admin endpoints, which are disabled when empty.
+	AdminToken string
+
+	// Backends lists every InfluxDB server and dongle whose results are
+	// summed. Without INFLUXDB_BACKENDS it holds the single backend given by
+	// the INFLUXDB_* and DONGLE variables.
+	Backends []BackendConfig
 }
 
 type Response struct {
@@ -29,254 +266,1831 @@ type Response struct {
 	Imported   float64 `json:"imported"`
 	Discharged float64 `json:"discharged"`
 	MaxPv      float64 `json:"maxPv"`
-	Error      string  `json:"error,omitempty"`
+	// Surplus is Generated minus Consumed; negative when more was consumed
+	// than produced.
+	Surplus    float64 `json:"surplus"`
+	EnergyUnit string  `json:"energyUnit,omitempty"`
+
+	// GridIndependencePct is the share of consumption not imported from
+	// the grid, and GridDependencePct the share that was; both are omitted
+	// when nothing was consumed.
+	GridIndependencePct *float64 `json:"gridIndependencePct,omitempty"`
+	GridDependencePct   *float64 `json:"gridDependencePct,omitempty"`
+
+	// BatteryRoundTripPct is Discharged as a share of the energy charged
+	// into the battery, kept in charged so backends can be combined; omitted
+	// when nothing was charged.
+	BatteryRoundTripPct *float64 `json:"batteryRoundTripPct,omitempty"`
+	charged             float64
+
+	// ProjectedDailyGenerated is a naive estimate of the day's total
+	// generation, extrapolating the hours of daylight so far. Only for the
+	// day timeframe.
+	ProjectedDailyGenerated *float64 `json:"projectedDailyGenerated,omitempty"`
+
+	// ExpectedGenerated is the clear-sky generation of the configured system
+	// over the timeframe, and PerformanceRatioPct Generated as a share of
+	// it. Both are omitted unless SYSTEM_CAPACITY_KW, LATITUDE and LONGITUDE
+	// are set.
+	ExpectedGenerated   *float64 `json:"expectedGenerated,omitempty"`
+	PerformanceRatioPct *float64 `json:"performanceRatioPct,omitempty"`
+
+	// Formatted repeats the values as strings with units, with
+	// ?formatted=true.
+	Formatted *FormattedResponse `json:"formatted,omitempty"`
+
+	// Extra holds the EXTRA_MEASUREMENTS values, in their stored units.
+	Extra map[string]float64 `json:"extra,omitempty"`
+
+	// Raw holds each queried measurement's value before scaling and
+	// summing, with ?raw=true. With several backends the keys are prefixed
+	// with the dongle.
+	Raw map[string]float64 `json:"raw,omitempty"`
+
+	// Comparison holds the previous period's values, with ?compare=true.
+	Comparison *Comparison `json:"comparison,omitempty"`
+
+	// Counts holds the number of samples behind each metric, with
+	// ?counts=true.
+	Counts map[string]int64 `json:"counts,omitempty"`
+
+	// DailyAverage holds the per-day totals and averages, with
+	// ?average=daily.
+	DailyAverage *DailyAverage `json:"dailyAverage,omitempty"`
+
+	// Profile holds a metric's hourly min, max and mean, with
+	// ?profile=hourly.
+	Profile *Profile `json:"profile,omitempty"`
+
+	// Delta holds the counters' increments since the poll that returned
+	// the ?since= cursor, and Cursor the cursor to pass on the next poll.
+	Delta  *Delta `json:"delta,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+
+	// Missing lists the optional fields whose query failed and which were
+	// reported as zero instead of failing the request.
+	Missing []string `json:"missing,omitempty"`
+
+	// Warnings flags values that are likely misleading, such as daily
+	// counters aggregated over several days.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Stale is set when InfluxDB failed and this is the last good Response
+	// served from the cache instead.
+	Stale bool `json:"stale,omitempty"`
+
+	// ResetGrace is set when the day timeframe still reports the previous
+	// day, within RESET_GRACE_SECONDS of the reset.
+	ResetGrace bool `json:"resetGrace,omitempty"`
+
+	// LastReading is the newest data point found with MAX_DATA_AGE set, and
+	// DataStale is set when there is none that recent, e.g. because the
+	// exporter died.
+	LastReading *time.Time `json:"lastReading,omitempty"`
+	DataStale   bool       `json:"dataStale,omitempty"`
+
+	// Partial is set when SOFT_DEADLINE passed before every query finished.
+	// The unresolved fields are rendered as null.
+	Partial    bool `json:"partial,omitempty"`
+	unresolved []string
+
+	// QueryDurationMs is the wall-clock time spent querying InfluxDB for
+	// this request, reported with ?timing=true. Zero means it was served
+	// from the cache.
+	QueryDurationMs *float64 `json:"queryDurationMs,omitempty"`
+	// SlowQueries maps each query over SLOW_QUERY_MS to its duration, also
+	// with ?timing=true.
+	SlowQueries map[string]float64 `json:"slowQueries,omitempty"`
+
+	EstimatedSavings          *float64 `json:"estimatedSavings,omitempty"`
+	EstimatedSavingsFormatted string   `json:"estimatedSavingsFormatted,omitempty"`
+
+	// EstimatedRuntimeMinutes is how long the battery's stored energy lasts
+	// at the current load, with BATTERY_CAPACITY_KWH set. batteryKWh and
+	// loadKW are its inputs, kept so backends can be combined.
+	EstimatedRuntimeMinutes *float64 `json:"estimatedRuntimeMinutes,omitempty"`
+	batteryKWh, loadKW      float64
+
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+}
+
+// Machine-stable values for Response.ErrorCode. Error carries the
+// human-readable message; clients should branch on ErrorCode instead.
+const (
+	// The timeframe query parameter is not one of the supported values
+	ErrorCodeInvalidTimeframe = "invalid_timeframe"
+	// InfluxDB could not be reached or answered with a server-side error
+	ErrorCodeBackendUnavailable = "backend_unavailable"
+	// InfluxDB rejected the query or returned a result that could not be read
+	ErrorCodeQueryFailed = "query_failed"
+	// A query parameter other than timeframe is malformed or out of range
+	ErrorCodeInvalidParameter = "invalid_parameter"
+	// The requested path doesn't match any route
+	ErrorCodeNotFound = "not_found"
+	// With STRICT_DONGLE, the dongle has never reported to the bucket
+	ErrorCodeUnknownDongle = "unknown_dongle"
+	// The timeframe is supported but not in ALLOWED_TIMEFRAMES
+	ErrorCodeTimeframeNotAllowed = "timeframe_not_allowed"
+	// With STALE_DATA_ERROR, nothing was written within MAX_DATA_AGE
+	ErrorCodeDataStale = "data_stale"
+)
+
+// ErrorResponse is the error body for endpoints that don't return a Response.
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	ErrorCode string `json:"errorCode"`
+}
+
+// writeJSON writes v as the response body with the given status. The
+// Content-Type is set before WriteHeader so that error responses are labeled
+// as JSON just like successful ones.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeResponseError reports a /solarshowdown failure in the Response shape
+// clients of that endpoint already parse.
+func writeResponseError(w http.ResponseWriter, status int, code string, err error) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, Response{Error: err.Error(), ErrorCode: code})
+}
+
+// errorCode classifies a query error into one of the ErrorCode values.
+func errorCode(err error) string {
+	if errors.Is(err, errUnknownDongle) {
+		return ErrorCodeUnknownDongle
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrorCodeBackendUnavailable
+	}
+
+	var httpErr *influxhttp.Error
+	if errors.As(err, &httpErr) && (httpErr.StatusCode == 0 || httpErr.StatusCode >= 500) {
+		return ErrorCodeBackendUnavailable
+	}
+
+	return ErrorCodeQueryFailed
+}
+
+// dataStaleError is the error reported with STALE_DATA_ERROR when nothing
+// was written within MAX_DATA_AGE.
+func dataStaleError(config *Config) string {
+	return fmt.Sprintf("no data within MAX_DATA_AGE (%s)", config.MaxDataAge)
+}
+
+// errorStatus is the HTTP status for a query error.
+func errorStatus(err error) int {
+	if errors.Is(err, errUnknownDongle) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// envInt reads an optional integer environment variable, returning def when
+// it is unset and an error when it is malformed or below minimum.
+func envInt(name string, def, minimum int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < minimum {
+		return 0, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return n, nil
+}
+
+// envFloat reads an optional non-negative float environment variable,
+// returning def when it is unset.
+func envFloat(name string, def float64) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return f, nil
+}
+
+// envDuration reads an optional non-negative duration environment variable
+// such as "30s", returning def when it is unset.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return d, nil
 }
 
 func loadConfig() (*Config, error) {
 	config := &Config{
-		InfluxDBURL:    os.Getenv("INFLUXDB_URL"),
-		InfluxDBToken:  os.Getenv("INFLUXDB_TOKEN"),
-		InfluxDBOrg:    os.Getenv("INFLUXDB_ORG"),
-		InfluxDBBucket: os.Getenv("INFLUXDB_BUCKET"),
-		ServerPort:     os.Getenv("SERVER_PORT"),
-		Dongle:         os.Getenv("DONGLE"),
+		InfluxDBURL:     os.Getenv("INFLUXDB_URL"),
+		InfluxDBToken:   os.Getenv("INFLUXDB_TOKEN"),
+		InfluxDBOrg:     os.Getenv("INFLUXDB_ORG"),
+		InfluxDBBucket:  os.Getenv("INFLUXDB_BUCKET"),
+		InfluxDBVersion: os.Getenv("INFLUXDB_VERSION"),
+		ServerPort:      os.Getenv("SERVER_PORT"),
+		BindAddress:     os.Getenv("BIND_ADDRESS"),
+		ServeUI:         os.Getenv("SERVE_UI") == "true",
+		LenientTypes:    os.Getenv("LENIENT_TYPES") == "true",
+		Dongle:          os.Getenv("DONGLE"),
+		AdminToken:      os.Getenv("ADMIN_TOKEN"),
+		TagKey:          os.Getenv("TAG_KEY"),
+		UserAgent:       os.Getenv("USER_AGENT"),
+		ClientLogLevel:  os.Getenv("INFLUXDB_CLIENT_LOG_LEVEL"),
+	}
+
+	if config.ClientLogLevel == "" {
+		config.ClientLogLevel = "error"
+	}
+	if _, ok := clientLogLevels[config.ClientLogLevel]; !ok && config.ClientLogLevel != "none" {
+		return nil, fmt.Errorf("invalid INFLUXDB_CLIENT_LOG_LEVEL: %s", config.ClientLogLevel)
+	}
+
+	if config.UserAgent == "" {
+		config.UserAgent = defaultUserAgent()
+	}
+
+	if config.TagKey == "" {
+		config.TagKey = "dongle"
+	}
+	if strings.ContainsAny(config.TagKey, `"\`) {
+		return nil, fmt.Errorf("invalid TAG_KEY: %s", config.TagKey)
+	}
+	if v := os.Getenv("TAG_VALUE"); v != "" {
+		if config.Dongle != "" && config.Dongle != v {
+			return nil, fmt.Errorf("DONGLE and TAG_VALUE are both set and differ")
+		}
+		config.Dongle = v
+	}
+
+	if config.ServerPort == "" {
+		config.ServerPort = "8080"
+	}
+	if _, err := net.ResolveTCPAddr("tcp", config.listenAddress()); err != nil {
+		return nil, fmt.Errorf("invalid BIND_ADDRESS or SERVER_PORT: %v", err)
+	}
+
+	var err error
+	if config.DayStartHour, err = envInt("DAY_START_HOUR", 0, 0); err != nil || config.DayStartHour > 23 {
+		return nil, fmt.Errorf("invalid DAY_START_HOUR: %s", os.Getenv("DAY_START_HOUR"))
+	}
+	graceSeconds, err := envInt("RESET_GRACE_SECONDS", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	config.ResetGrace = time.Duration(graceSeconds) * time.Second
+	if config.GzipLevel, err = envInt("GZIP_LEVEL", gzip.DefaultCompression, gzip.HuffmanOnly); err != nil || config.GzipLevel > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid GZIP_LEVEL: %s, expected -2 to 9", os.Getenv("GZIP_LEVEL"))
+	}
+	if config.RangePrecision, err = envDuration("RANGE_PRECISION", time.Minute); err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("NOW"); v != "" {
+		pinned, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NOW %q: expected RFC 3339, e.g. 2024-06-21T15:04:05Z", v)
+		}
+		config.Clock = func() time.Time { return pinned }
+	}
+	config.ResponseTZ = time.UTC
+	if v := os.Getenv("RESPONSE_TZ"); v != "" {
+		if config.ResponseTZ, err = time.LoadLocation(v); err != nil {
+			return nil, fmt.Errorf("invalid RESPONSE_TZ %q: %v", v, err)
+		}
+	}
+	if config.MaxConcurrentQueries, err = envInt("MAX_CONCURRENT_QUERIES", 6, 0); err != nil {
+		return nil, err
+	}
+	if config.DailyMaxDays, err = envInt("DAILY_MAX_DAYS", 90, 1); err != nil {
+		return nil, err
+	}
+
+	if os.Getenv("IMPORT_RATE") != "" || os.Getenv("TARIFF_WINDOWS") != "" {
+		config.SavingsEnabled = true
+		if config.ImportRate, err = envFloat("IMPORT_RATE", 0); err != nil {
+			return nil, err
+		}
+		if config.ExportRate, err = envFloat("EXPORT_RATE", 0); err != nil {
+			return nil, err
+		}
+	}
+	if v := os.Getenv("TARIFF_WINDOWS"); v != "" {
+		if config.TariffWindows, err = parseTariffWindows(v, config.ExportRate); err != nil {
+			return nil, err
+		}
+	}
+	config.CurrencySymbol = os.Getenv("CURRENCY_SYMBOL")
+	if config.CurrencySymbol == "" {
+		config.CurrencySymbol = "$"
+	}
+	if config.CurrencyDecimals, err = envInt("CURRENCY_DECIMALS", 2, 0); err != nil {
+		return nil, err
+	}
+
+	if config.CacheTTL, err = envDuration("CACHE_TTL", 0); err != nil {
+		return nil, err
+	}
+	config.CacheTTLs = make(map[string]time.Duration)
+	for _, timeframe := range timeframes {
+		if config.CacheTTLs[timeframe], err = envDuration("CACHE_TTL_"+strings.ToUpper(timeframe), config.CacheTTL); err != nil {
+			return nil, err
+		}
+	}
+	if os.Getenv("CACHE_CONTROL_MAX_AGE") != "" {
+		config.CacheControlMaxAgeSet = true
+		if config.CacheControlMaxAge, err = envDuration("CACHE_CONTROL_MAX_AGE", 0); err != nil {
+			return nil, err
+		}
+	}
+	if config.CacheMaxEntries, err = envInt("CACHE_MAX_ENTRIES", 1000, 0); err != nil {
+		return nil, err
+	}
+	if config.ServeStaleMaxAge, err = envDuration("SERVE_STALE_MAX_AGE", 0); err != nil {
+		return nil, err
+	}
+	if config.QueryTimeout, err = envDuration("QUERY_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if config.SoftDeadline, err = envDuration("SOFT_DEADLINE", 0); err != nil {
+		return nil, err
+	}
+	if config.MaxDataAge, err = envDuration("MAX_DATA_AGE", 0); err != nil {
+		return nil, err
+	}
+	config.StaleDataError = os.Getenv("STALE_DATA_ERROR") == "true"
+	config.CoalesceQueries = os.Getenv("COALESCE_QUERIES") != "false"
+	slowMs, err := envInt("SLOW_QUERY_MS", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	config.SlowQuery = time.Duration(slowMs) * time.Millisecond
+	retryMs, err := envInt("RETRY_EMPTY_MS", 0, 0)
+	if err != nil || retryMs > maxRetryEmptyMs {
+		return nil, fmt.Errorf("invalid RETRY_EMPTY_MS: %s, expected 0 to %d", os.Getenv("RETRY_EMPTY_MS"), maxRetryEmptyMs)
+	}
+	config.RetryEmpty = time.Duration(retryMs) * time.Millisecond
+
+	config.Metrics = defaultMetricSources()
+	if v := os.Getenv("MEASUREMENT_MAP"); v != "" {
+		if config.Metrics, err = parseMeasurementMap(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := os.Getenv("DOWNSAMPLED_MEASUREMENTS"); v != "" {
+		if config.Downsampled, err = parseDownsampledMeasurements(v, config.Metrics); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.PivotedSchema = os.Getenv("PIVOTED_SCHEMA") == "true"; config.PivotedSchema {
+		config.PivotedMeasurement = os.Getenv("PIVOTED_MEASUREMENT")
+		if config.PivotedMeasurement == "" || strings.ContainsAny(config.PivotedMeasurement, `"\`) {
+			return nil, fmt.Errorf("PIVOTED_SCHEMA requires a valid PIVOTED_MEASUREMENT")
+		}
+	}
+
+	if config.ValueField = os.Getenv("VALUE_FIELD"); config.ValueField == "" {
+		config.ValueField = "value"
+	} else if strings.ContainsAny(config.ValueField, `"\`) {
+		return nil, fmt.Errorf("invalid VALUE_FIELD: %s", config.ValueField)
+	}
+
+	config.TrustProxy = os.Getenv("TRUST_PROXY") == "true"
+	if config.TrustProxyIndex, err = envInt("TRUST_PROXY_INDEX", 0, -64); err != nil {
+		return nil, err
+	}
+
+	if config.WebhookURL = os.Getenv("WEBHOOK_URL"); config.WebhookURL != "" {
+		if u, err := url.Parse(config.WebhookURL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid WEBHOOK_URL: expected an http:// or https:// URL")
+		}
+		if config.WebhookSchedule, err = parseCron(os.Getenv("WEBHOOK_SCHEDULE")); err != nil {
+			return nil, fmt.Errorf("invalid WEBHOOK_SCHEDULE: %v", err)
+		}
+		if config.WebhookTimeframe = os.Getenv("WEBHOOK_TIMEFRAME"); config.WebhookTimeframe == "" {
+			config.WebhookTimeframe = "day"
+		}
+		if !slices.Contains(timeframes, config.WebhookTimeframe) {
+			return nil, fmt.Errorf("invalid WEBHOOK_TIMEFRAME: %s", config.WebhookTimeframe)
+		}
+	}
+
+	if config.SunriseHour, err = envInt("SUNRISE_HOUR", 0, 0); err != nil {
+		return nil, err
+	}
+	if config.SunsetHour, err = envInt("SUNSET_HOUR", 24, 0); err != nil {
+		return nil, err
+	}
+	if config.SunsetHour > 24 || config.SunriseHour >= config.SunsetHour {
+		return nil, fmt.Errorf("invalid SUNRISE_HOUR and SUNSET_HOUR: %d to %d", config.SunriseHour, config.SunsetHour)
+	}
+	if config.MaxPvCapKW, err = envFloat("MAX_PV_CAP", 0); err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("MAX_DAILY_KWH"); v != "" {
+		if config.DailyCeilings, err = parseDailyCeilings(v); err != nil {
+			return nil, err
+		}
+	}
+	config.SanityAction = os.Getenv("SANITY_ACTION")
+	switch config.SanityAction {
+	case "":
+		config.SanityAction = sanityWarn
+	case sanityWarn, sanityClamp, sanityDrop:
+	default:
+		return nil, fmt.Errorf("invalid SANITY_ACTION %q: expected %s, %s or %s",
+			config.SanityAction, sanityWarn, sanityClamp, sanityDrop)
+	}
+	if config.SystemCapacityKW, err = envFloat("SYSTEM_CAPACITY_KW", 0); err != nil {
+		return nil, err
+	}
+	for _, coord := range []struct {
+		name  string
+		limit float64
+		dst   **float64
+	}{
+		{"LATITUDE", 90, &config.Latitude},
+		{"LONGITUDE", 180, &config.Longitude},
+	} {
+		v := os.Getenv(coord.name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.Abs(f) > coord.limit {
+			return nil, fmt.Errorf("invalid %s: %s", coord.name, v)
+		}
+		*coord.dst = &f
+	}
+	if config.StreakThresholdKWh, err = envFloat("STREAK_THRESHOLD_KWH", 0); err != nil {
+		return nil, err
+	}
+	if config.StreakMaxDays, err = envInt("STREAK_MAX_DAYS", 365, 1); err != nil {
+		return nil, err
+	}
+	if config.MinGenerationKWh, err = envFloat("MIN_GENERATION_KWH", 0); err != nil {
+		return nil, err
+	}
+
+	config.StrictDongle = os.Getenv("STRICT_DONGLE") == "true"
+	config.CombinedQuery = os.Getenv("COMBINED_QUERY") == "true"
+
+	if config.BatteryCapacityKWh, err = envFloat("BATTERY_CAPACITY_KWH", 0); err != nil {
+		return nil, err
+	}
+
+	config.ConsumptionMode = os.Getenv("CONSUMPTION_MODE")
+	switch config.ConsumptionMode {
+	case "":
+		config.ConsumptionMode = ConsumptionMeasured
+	case ConsumptionMeasured, ConsumptionNet, ConsumptionGross:
+	default:
+		return nil, fmt.Errorf("invalid CONSUMPTION_MODE %q: expected %s, %s or %s",
+			config.ConsumptionMode, ConsumptionMeasured, ConsumptionNet, ConsumptionGross)
+	}
+
+	if v := os.Getenv("ALLOWED_TIMEFRAMES"); v != "" {
+		for _, timeframe := range strings.Split(v, ",") {
+			if timeframe = strings.TrimSpace(timeframe); timeframe == "" {
+				continue
+			}
+			if !slices.Contains(timeframes, timeframe) {
+				return nil, fmt.Errorf("invalid ALLOWED_TIMEFRAMES entry: %s", timeframe)
+			}
+			config.AllowedTimeframes = append(config.AllowedTimeframes, timeframe)
+		}
+	}
+
+	if v := os.Getenv("PV_POWER_STRINGS"); v != "" {
+		for _, measurement := range strings.Split(v, ",") {
+			if measurement = strings.TrimSpace(measurement); measurement != "" {
+				config.PvPowerStrings = append(config.PvPowerStrings, measurement)
+			}
+		}
+	}
+
+	if v := os.Getenv("EXTRA_MEASUREMENTS"); v != "" {
+		if config.ExtraMeasurements, err = parseExtraMeasurements(v); err != nil {
+			return nil, err
+		}
+	}
+
+	config.OmitZeros = os.Getenv("OMIT_ZEROS") == "true"
+	config.AllowPost = os.Getenv("ALLOW_POST") == "true"
+	if v := os.Getenv("FIELD_NAMES"); v != "" {
+		if config.FieldNames, err = parseFieldNames(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := os.Getenv("DECIMAL_PLACES"); v != "" {
+		if config.DecimalPlaces, err = parseDecimalPlaces(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := os.Getenv("NUMBER_TYPES"); v != "" {
+		if config.NumberTypes, err = parseNumberTypes(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.FormatDecimals, err = envInt("FORMAT_DECIMALS", 1, 0); err != nil {
+		return nil, err
+	}
+
+	config.EnergyUnit = os.Getenv("ENERGY_UNIT")
+	switch config.EnergyUnit {
+	case "":
+		config.EnergyUnit = "kWh"
+	case "kWh", "Wh":
+	default:
+		return nil, fmt.Errorf("invalid ENERGY_UNIT: %s", config.EnergyUnit)
+	}
+
+	if config.InfluxDBVersion == "" {
+		config.InfluxDBVersion = "2"
+	}
+
+	if v := os.Getenv("INFLUXDB_BACKENDS"); v != "" {
+		if err := json.Unmarshal([]byte(v), &config.Backends); err != nil {
+			return nil, fmt.Errorf("invalid INFLUXDB_BACKENDS: %v", err)
+		}
+		if len(config.Backends) == 0 {
+			return nil, fmt.Errorf("invalid INFLUXDB_BACKENDS: no backends defined")
+		}
+	} else {
+		var dongles []string
+		if config.Dongle != "" {
+			dongles = []string{config.Dongle}
+		}
+		config.Backends = []BackendConfig{{
+			URL:      config.InfluxDBURL,
+			Token:    config.InfluxDBToken,
+			Org:      config.InfluxDBOrg,
+			Bucket:   config.InfluxDBBucket,
+			Dongles:  dongles,
+			Username: os.Getenv("INFLUXDB_USERNAME"),
+			Password: os.Getenv("INFLUXDB_PASSWORD"),
+		}}
+	}
+
+	if config.DemoMode = os.Getenv("DEMO_MODE") == "true"; config.DemoMode {
+		// Nothing is queried, so any missing InfluxDB settings are fine
+		if config.Dongle == "" {
+			config.Dongle = "demo"
+		}
+		config.Backends = []BackendConfig{{URL: "http://demo.invalid", Dongles: []string{config.Dongle}}}
+		config.InfluxDBURL = config.Backends[0].URL
+		return config, nil
+	}
+
+	for i, b := range config.Backends {
+		var err error
+		b.Token, err = backendToken(config.InfluxDBVersion, b)
+		if err == nil {
+			config.Backends[i].Token = b.Token
+			err = validateBackend(config.InfluxDBVersion, b)
+		}
+		if err == nil {
+			config.Backends[i].URL, err = normalizeInfluxDBURL(b.URL)
+		}
+		if err != nil {
+			if len(config.Backends) == 1 {
+				return nil, err
+			}
+			return nil, fmt.Errorf("backend %d: %w", i, err)
+		}
+	}
+	config.InfluxDBURL = config.Backends[0].URL
+
+	if v := os.Getenv("DONGLE_OVERRIDES"); v != "" {
+		if config.DongleOverrides, err = parseDongleOverrides(v, config.Backends); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// backendToken returns the token to authenticate to b with: the
+// "username:password" form InfluxDB 1.x accepts when a username and
+// password are configured, or b.Token. At most one of the two may be set.
+func backendToken(version string, b BackendConfig) (string, error) {
+	if b.Username == "" && b.Password == "" {
+		return b.Token, nil
+	}
+	if b.Token != "" {
+		return "", fmt.Errorf("set either a token or a username and password, not both")
+	}
+	if b.Username == "" {
+		return "", fmt.Errorf("a password requires a username")
+	}
+	if version != "1" {
+		return "", fmt.Errorf("username and password authentication requires INFLUXDB_VERSION=1")
+	}
+	return b.Username + ":" + b.Password, nil
+}
+
+func validateBackend(version string, b BackendConfig) error {
+	switch version {
+	case "2":
+		// Validate required configuration
+		if b.URL == "" || b.Token == "" || b.Org == "" || b.Bucket == "" ||
+			len(b.Dongles) == 0 {
+			return fmt.Errorf("missing required configuration")
+		}
+	case "1":
+		// InfluxDB 1.8+ serves Flux through its 2.x compatibility endpoint.
+		// The org is ignored, the token is "username:password" (or empty when
+		// auth is disabled) and the bucket is "database/retention-policy",
+		// where omitting the retention policy selects the database default.
+		if b.URL == "" || b.Bucket == "" || len(b.Dongles) == 0 {
+			return fmt.Errorf("missing required configuration")
+		}
+	default:
+		return fmt.Errorf("invalid INFLUXDB_VERSION: %s", version)
+	}
+
+	for _, dongle := range b.Dongles {
+		if dongle == "" {
+			return fmt.Errorf("empty dongle identifier")
+		}
+	}
+
+	return nil
+}
+
+// normalizeInfluxDBURL checks that raw is an absolute http(s) URL, so a
+// missing scheme fails at startup rather than deep inside the client, and
+// trims any trailing slashes.
+func normalizeInfluxDBURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid InfluxDB URL %q: %v", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("invalid InfluxDB URL %q: expected http:// or https:// followed by a host, e.g. http://localhost:8086", raw)
+	}
+
+	return strings.TrimRight(raw, "/"), nil
+}
+
+// dayStart returns the start of the daily counter window containing t's
+// local calendar date, in UTC. With DAY_START_HOUR the day runs from that
+// hour, and t before it belongs to the previous day.
+func dayStart(config *Config, t time.Time) time.Time {
+	local := t.In(time.Local).Add(-time.Duration(config.DayStartHour) * time.Hour)
+	// Get midnight in local time, then convert to UTC
+	// Add a 1 minute offset to the local midnight because it seems that the eg4 lags a bit to reset the value to zero.
+	localMidnight := time.Date(local.Year(), local.Month(), local.Day(), config.DayStartHour, 1, 0, 0, time.Local)
+	return localMidnight.UTC()
+}
+
+// inResetGrace reports whether t falls within RESET_GRACE_SECONDS of the
+// day's counter reset, including the minute before the offset reset.
+func inResetGrace(config *Config, t time.Time) bool {
+	return config.ResetGrace > 0 && t.Before(dayStart(config, t).Add(config.ResetGrace))
+}
+
+// nextDayStart returns the first daily counter reset after t.
+func nextDayStart(config *Config, t time.Time) time.Time {
+	if start := dayStart(config, t); start.After(t) {
+		return start
 	}
+	return dayStart(config, t.AddDate(0, 0, 1))
+}
 
-	if config.ServerPort == "" {
-		config.ServerPort = "8080"
+// fluxAggregate returns the Flux call reducing a series with aggregation.
+// "increase" totals a counter's rises, counting a drop as a reset, so it
+// sums daily counters across their midnight reset.
+func fluxAggregate(aggregation string) string {
+	if aggregation == "increase" {
+		return "increase()\n\t\t\t|> last()"
 	}
+	return aggregation + "()"
+}
 
-	// Validate required configuration
-	if config.InfluxDBURL == "" || config.InfluxDBToken == "" ||
-		config.InfluxDBOrg == "" || config.InfluxDBBucket == "" ||
-		config.Dongle == "" {
-		return nil, fmt.Errorf("missing required configuration")
+// listenAddress is the host:port the server listens on.
+func (config *Config) listenAddress() string {
+	return net.JoinHostPort(config.BindAddress, config.ServerPort)
+}
+
+// now returns the current time from config.Clock, or the wall clock.
+func (config *Config) now() time.Time {
+	if config.Clock != nil {
+		return config.Clock()
 	}
+	return time.Now()
+}
 
-	return config, nil
+// responseTime returns t in config.ResponseTZ for writing into a response.
+func (config *Config) responseTime(t time.Time) time.Time {
+	return t.In(config.ResponseTZ)
 }
 
-func calculateRangeStart(timeframe string) (time.Time, error) {
-	now := time.Now()
+// timeframes lists every supported timeframe value.
+var timeframes = []string{"day", "yesterday", "week", "isoweek", "month"}
+
+// calculateRange returns the [start, stop) query window for a timeframe. A
+// zero stop means the window is still open and runs up to now.
+func calculateRange(config *Config, timeframe string) (start, stop time.Time, err error) {
+	now := config.now()
+	open := zeroTime
+	if config.Clock != nil {
+		open = now.UTC()
+	}
 
 	switch timeframe {
 	case "day":
-		// Get midnight in local time, then convert to UTC
-		// Add a 1 minute offset to the local midnight because it seems that the eg4 lags a bit to reset the value to zero.
-		localMidnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 1, 0, 0, time.Local)
-		return localMidnight.UTC(), nil
+		if inResetGrace(config, now) {
+			// Still the previous day, up to its final reading
+			return dayStart(config, now.AddDate(0, 0, -1)), dayStart(config, now), nil
+		}
+		return dayStart(config, now), open, nil
+	case "yesterday":
+		// Closed at today's reset so the totals no longer change
+		today := dayStart(config, now)
+		return dayStart(config, now.AddDate(0, 0, -1)), today, nil
 	case "week":
-		return now.AddDate(0, 0, -7).UTC(), nil
+		return now.AddDate(0, 0, -7).UTC().Truncate(config.RangePrecision), open, nil
+	case "isoweek":
+		// The ISO week to date, from the start of the latest Monday
+		today := dayStart(config, now).In(time.Local)
+		sinceMonday := (int(today.Weekday()) + 6) % 7
+		return dayStart(config, today.AddDate(0, 0, -sinceMonday)), open, nil
 	case "month":
-		return now.AddDate(0, -1, 0).UTC(), nil
-	default:
-		return time.Time{}, fmt.Errorf("invalid timeframe: %s", timeframe)
+		return now.AddDate(0, -1, 0).UTC().Truncate(config.RangePrecision), open, nil
+	}
+
+	month, ok := calendarMonth(timeframe)
+	if !ok {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid timeframe: %s", timeframe)
+	}
+	start = monthStart(config, month)
+	if start.After(now) {
+		return time.Time{}, time.Time{}, fmt.Errorf("month %s is in the future", timeframe)
 	}
+	return start, monthStart(config, month.AddDate(0, 1, 0)), nil
+}
+
+// calendarMonth parses the "YYYY-MM" timeframe of ?month=, a whole local
+// calendar month.
+func calendarMonth(timeframe string) (time.Time, bool) {
+	month, err := time.ParseInLocation("2006-01", timeframe, time.Local)
+	return month, err == nil
+}
+
+// monthStart returns the start of the first day of month.
+func monthStart(config *Config, month time.Time) time.Time {
+	return dayStart(config, month.Add(time.Duration(config.DayStartHour)*time.Hour))
+}
+
+// timeframeClass is the named timeframe whose settings apply to timeframe:
+// calendar months follow month.
+func timeframeClass(timeframe string) string {
+	if _, ok := calendarMonth(timeframe); ok {
+		return "month"
+	}
+	return timeframe
+}
+
+// queryTimeframe reads ?timeframe=, defaulting to day, for the endpoints
+// that take a single timeframe. It writes the error response itself when
+// the timeframe is invalid or not allowed.
+func queryTimeframe(w http.ResponseWriter, r *http.Request, config *Config) (string, bool) {
+	timeframe := r.URL.Query().Get("timeframe")
+	if timeframe == "" {
+		timeframe = "day" // Default timeframe
+	}
+	if _, _, err := calculateRange(config, timeframe); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error(), ErrorCode: ErrorCodeInvalidTimeframe})
+		return "", false
+	}
+	if !config.timeframeAllowed(timeframe) {
+		writeJSON(w, http.StatusForbidden, ErrorResponse{
+			Error:     fmt.Sprintf("timeframe not allowed: %s", timeframe),
+			ErrorCode: ErrorCodeTimeframeNotAllowed,
+		})
+		return "", false
+	}
+	return timeframe, true
+}
+
+// timeframeAllowed reports whether ALLOWED_TIMEFRAMES permits a timeframe.
+func (config *Config) timeframeAllowed(timeframe string) bool {
+	return len(config.AllowedTimeframes) == 0 || slices.Contains(config.AllowedTimeframes, timeframeClass(timeframe))
+}
+
+// cacheTTL is how long a timeframe's responses are cached.
+func (config *Config) cacheTTL(timeframe string) time.Duration {
+	return config.CacheTTLs[timeframeClass(timeframe)]
 }
 
-func processQueryResult(result *api.QueryTableResult) (float64, error) {
+// processQueryResult reads the single value of a query on source, a name
+// used in logs.
+func processQueryResult(config *Config, result *api.QueryTableResult, source string) (float64, error) {
+	value, _, err := readQueryResult(config, result, source)
+	return value, err
+}
+
+// readQueryResult is processQueryResult, also reporting whether the query
+// returned a record at all.
+func readQueryResult(config *Config, result *api.QueryTableResult, source string) (float64, bool, error) {
 	// Default to 0 if no results
 	if !result.Next() {
-		return 0, nil
+		return 0, false, result.Err()
 	}
 
 	// Get the first (and only) value
 	value := result.Record().Value()
-	if value == nil {
+
+	// max() yields one record per series, so more than one means the filters
+	// didn't pin down a single series and any pick would be arbitrary.
+	records := 1
+	for result.Next() {
+		records++
+	}
+	if err := result.Err(); err != nil {
+		return 0, true, err
+	}
+	if records > 1 {
+		return 0, true, fmt.Errorf("query matched %d series, expected 1; check that the dongle filter is specific enough", records)
+	}
+
+	v, err := numericValue(config, value, source)
+	return v, true, err
+}
+
+// numericValue converts a value read from InfluxDB to a float64. Integer
+// fields are converted as they are; with LENIENT_TYPES, so are numbers
+// stored as strings, with a warning, since exporters should write them as
+// numbers.
+func numericValue(config *Config, value any, source string) (float64, error) {
+	switch v := value.(type) {
+	case nil:
 		return 0, nil
+	case float64:
+		return finiteValue(v, source), nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case string:
+		if config.LenientTypes {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return 0, fmt.Errorf("unexpected non-numeric string value %q", v)
+			}
+			log.Printf("InfluxDB returned the string %q for %s, read as a number", v, source)
+			return finiteValue(f, source), nil
+		}
+	}
+	return 0, fmt.Errorf("unexpected value type: %T", value)
+}
+
+// finiteValue replaces a NaN or infinite value from InfluxDB, which
+// encoding/json can't marshal, with 0, and logs it so the bad data can be
+// tracked down.
+func finiteValue(v float64, source string) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		log.Printf("InfluxDB returned %v for %s, using 0", v, source)
+		return 0
 	}
+	return v
+}
 
-	// Convert to float64
-	floatValue, ok := value.(float64)
-	if !ok {
-		return 0, fmt.Errorf("unexpected value type: %T", value)
+// querySlots bounds the number of InfluxDB queries in flight across all
+// requests. A nil channel means no limit.
+var querySlots chan struct{}
+
+// acquireQuerySlot blocks until a query slot is free or ctx is done.
+func acquireQuerySlot(ctx context.Context) error {
+	if querySlots == nil {
+		return nil
 	}
 
-	return floatValue, result.Err()
+	select {
+	case querySlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func queryMeasurement(client influxdb2.Client, config *Config, measurement string, start time.Time) (float64, error) {
-	queryAPI := client.QueryAPI(config.InfluxDBOrg)
+func releaseQuerySlot() {
+	if querySlots != nil {
+		<-querySlots
+	}
+}
 
-	query := fmt.Sprintf(`
-		from(bucket:"%[1]s")
-			|> range(start: %[2]s)
-			|> filter(fn: (r) => r["_measurement"] == "%[3]s")
-			|> filter(fn: (r) => r["_field"] == "value")
-			|> filter(fn: (r) => r["dongle"] == "%[4]s")
-			|> max()`,
-		config.InfluxDBBucket,
-		start.Format(time.RFC3339),
-		measurement,
-		config.Dongle)
+// zeroTime is the stop value for ranges that run up to now.
+var zeroTime time.Time
 
-	result, err := queryAPI.Query(context.Background(), query)
-	if err != nil {
-		return 0, fmt.Errorf("query failed for %s: %v", measurement, err)
+// fluxRange formats the arguments of a Flux range() call, omitting stop
+// when it is zero.
+func fluxRange(start, stop time.Time) string {
+	r := "start: " + start.Format(time.RFC3339)
+	if !stop.IsZero() {
+		r += ", stop: " + stop.Format(time.RFC3339)
+	}
+	return r
+}
+
+// seriesFilter returns the Flux filters selecting the named measurements.
+// Normally each is its own _measurement, read through its ValueField only;
+// with PIVOTED_SCHEMA they are fields of the single PivotedMeasurement
+// instead.
+func seriesFilter(config *Config, names ...string) string {
+	match := func(column string) string {
+		matches := make([]string, len(names))
+		for i, name := range names {
+			matches[i] = fmt.Sprintf(`r["%s"] == "%s"`, column, name)
+		}
+		return strings.Join(matches, " or ")
 	}
 
-	return processQueryResult(result)
+	measurement, field := match("_measurement"), fmt.Sprintf(`r["_field"] == "%s"`, config.ValueField)
+	if config.PivotedSchema {
+		measurement, field = fmt.Sprintf(`r["_measurement"] == "%s"`, config.PivotedMeasurement), match("_field")
+	}
+
+	return fmt.Sprintf("filter(fn: (r) => %s)\n\t\t\t|> filter(fn: (r) => %s)", measurement, field)
 }
 
-func queryGenerated(client influxdb2.Client, config *Config, timeframe string) (float64, error) {
-	start, err := calculateRangeStart(timeframe)
-	if err != nil {
-		return 0, err
+// maxRetryEmptyMs bounds RETRY_EMPTY_MS, so the retry covers write
+// visibility lag rather than waiting out a genuinely empty period.
+const maxRetryEmptyMs = 5000
+
+// queryAggregate reduces a measurement over [start, stop) with the named
+// Flux aggregate function, such as max or mean.
+func queryAggregate(ctx context.Context, client influxdb2.Client, config *Config, measurement, aggregation string, start, stop time.Time) (float64, error) {
+	if config.DemoMode {
+		// Only the Response metrics have synthetic data
+		return 0, nil
 	}
 
-	measurements := []string{"lux_Epv1_day", "lux_Epv2_day", "lux_Epv3_day"}
-	var total float64
+	queryAPI := client.QueryAPI(config.InfluxDBOrg)
+	query := aggregateQuery(config, measurement, aggregation, start, stop)
 
-	for _, measurement := range measurements {
-		value, err := queryMeasurement(client, config, measurement, start)
+	// RETRY_EMPTY_MS retries once when a range reaching now comes back
+	// empty, in case its latest points weren't visible yet
+	retry := config.RetryEmpty > 0 && (stop.IsZero() || !stop.Before(config.now()))
+	for {
+		value, found, err := runAggregateQuery(ctx, queryAPI, config, measurement, query)
 		if err != nil {
 			return 0, err
 		}
-		total += value
+		if found || !retry {
+			recordRaw(ctx, measurement, value)
+			return value, nil
+		}
+		retry = false
+		logf(ctx, "%s returned no data, retrying in %s", measurement, config.RetryEmpty)
+		select {
+		case <-time.After(config.RetryEmpty):
+		case <-ctx.Done():
+			return 0, fmt.Errorf("query failed for %s: %w", measurement, ctx.Err())
+		}
 	}
+}
 
-	return total, nil
+// aggregateQuery builds the Flux query of queryAggregate.
+func aggregateQuery(config *Config, measurement, aggregation string, start, stop time.Time) string {
+	return fmt.Sprintf(`
+		from(bucket:"%[1]s")
+			|> range(%[2]s)
+			|> %[3]s
+			|> filter(fn: (r) => r["%[6]s"] == "%[4]s")%[7]s
+			|> %[5]s`,
+		config.InfluxDBBucket,
+		fluxRange(start, stop),
+		seriesFilter(config, measurement),
+		config.Dongle,
+		fluxAggregate(aggregation),
+		config.TagKey,
+		ceilingFilter(config))
 }
 
-func queryConsumed(client influxdb2.Client, config *Config, timeframe string) (float64, error) {
-	start, err := calculateRangeStart(timeframe)
+// runAggregateQuery runs a queryAggregate query, reporting whether it
+// returned a record.
+func runAggregateQuery(ctx context.Context, queryAPI api.QueryAPI, config *Config, measurement, query string) (float64, bool, error) {
+	if err := acquireQuerySlot(ctx); err != nil {
+		return 0, false, fmt.Errorf("waiting to query %s: %w", measurement, err)
+	}
+	defer releaseQuerySlot()
+	defer observeQuery(ctx, config, measurement, time.Now())
+
+	result, err := queryAPI.Query(ctx, query)
 	if err != nil {
-		return 0, err
+		return 0, false, fmt.Errorf("query failed for %s: %w", measurement, err)
 	}
+	defer result.Close()
 
-	watts, err := queryMeasurement(client, config, "lux_DailyConsumption", start)
+	value, found, err := readQueryResult(config, result, measurement)
 	if err != nil {
-		return 0, err
+		return 0, false, fmt.Errorf("reading result for %s: %w", measurement, err)
 	}
+	return value, found, nil
+}
 
-	return watts / 1000, nil
+// batteryRoundTrip returns Response.BatteryRoundTripPct, clamped to
+// [0, 100]: over a short window the battery can discharge energy charged
+// before it started.
+func batteryRoundTrip(response Response) *float64 {
+	if response.charged <= 0 {
+		return nil
+	}
+	pct := min(max(response.Discharged/response.charged*100, 0), 100)
+	return &pct
 }
 
-func queryExported(client influxdb2.Client, config *Config, timeframe string) (float64, error) {
-	start, err := calculateRangeStart(timeframe)
-	if err != nil {
-		return 0, err
+// gridReliance returns Response.GridIndependencePct and GridDependencePct,
+// clamped to [0, 100] since counters sampled at slightly different times
+// can put imported above consumed.
+func gridReliance(response Response) (independence, dependence *float64) {
+	if response.Consumed <= 0 {
+		return nil, nil
 	}
+	dependent := min(max(response.Imported/response.Consumed*100, 0), 100)
+	independent := 100 - dependent
+	return &independent, &dependent
+}
+
+// projectDaily extrapolates generated over the share of today's
+// SUNRISE_HOUR to SUNSET_HOUR daylight that has elapsed. It is nil outside
+// the day timeframe, within RESET_GRACE_SECONDS and before sunrise, when
+// there is nothing to go on.
+func projectDaily(config *Config, timeframe string, generated float64) *float64 {
+	if timeframe != "day" || inResetGrace(config, config.now()) {
+		return nil
+	}
+	now := config.now().In(time.Local)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	sunrise := midnight.Add(time.Duration(config.SunriseHour) * time.Hour)
+	sunset := midnight.Add(time.Duration(config.SunsetHour) * time.Hour)
 
-	return queryMeasurement(client, config, "lux_Etogrid_day", start)
+	elapsed := min(float64(now.Sub(sunrise))/float64(sunset.Sub(sunrise)), 1)
+	if elapsed <= 0 {
+		return nil
+	}
+	projected := generated / elapsed
+	return &projected
 }
 
-func queryDischarged(client influxdb2.Client, config *Config, timeframe string) (float64, error) {
-	start, err := calculateRangeStart(timeframe)
-	if err != nil {
-		return 0, err
+// clearSkyComparison returns Response.ExpectedGenerated in the configured
+// energy unit and the PerformanceRatioPct of generated, already converted,
+// against it.
+func clearSkyComparison(config *Config, timeframe string, generated float64) (expected, ratio *float64) {
+	kwh := expectedClearSky(config, timeframe)
+	if kwh == nil {
+		return nil, nil
 	}
+	converted := convertEnergy(config, *kwh)
+	return &converted, performanceRatio(generated, &converted)
+}
 
-	return queryMeasurement(client, config, "lux_Edischg_day", start)
+// convertEnergy converts a kWh value, as returned by the query functions,
+// into the configured energy unit.
+func convertEnergy(config *Config, kwh float64) float64 {
+	if config.EnergyUnit == "Wh" {
+		return kwh * 1000
+	}
+	return kwh
 }
 
-func queryImported(client influxdb2.Client, config *Config, timeframe string) (float64, error) {
-	start, err := calculateRangeStart(timeframe)
-	if err != nil {
-		return 0, err
+type metricQuery func(ctx context.Context, client influxdb2.Client, config *Config, timeframe string) (float64, error)
+
+// queryResponse runs the metric queries concurrently and assembles the
+// Response. The first failure cancels the remaining queries.
+func queryResponse(ctx context.Context, client influxdb2.Client, config *Config, timeframe string, fields fieldSet) (Response, error) {
+	config = downsampledConfig(config, timeframe)
+	if config.StrictDongle && !config.DemoMode {
+		if err := checkDongle(ctx, client, config); err != nil {
+			return Response{}, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var raw *rawValues
+	if rawRequested(ctx) {
+		ctx, raw = withRawValues(ctx)
+	}
+	ctx, warnings := withWarnings(ctx)
+
+	// Queries still running at SOFT_DEADLINE are abandoned and their fields
+	// left unresolved, rather than failing the request
+	queryCtx := ctx
+	if config.SoftDeadline > 0 {
+		var softCancel context.CancelFunc
+		queryCtx, softCancel = context.WithTimeout(ctx, config.SoftDeadline)
+		defer softCancel()
+	}
+	expired := func() bool { return ctx.Err() == nil && queryCtx.Err() != nil }
+
+	var (
+		response   Response
+		touSavings float64
+		wg         sync.WaitGroup
+		once       sync.Once
+		firstErr   error
+		missingMu  sync.Mutex
+	)
+
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	unresolve := func(names ...string) {
+		missingMu.Lock()
+		response.unresolved = append(response.unresolved, names...)
+		missingMu.Unlock()
+	}
+
+	// run queries dst in the background. An optional query that fails is
+	// recorded under name in Response.Missing rather than failing the rest.
+	run := func(dst *float64, query metricQuery, optional bool, name string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := query(queryCtx, client, config, timeframe)
+			if err != nil && expired() {
+				unresolve(name)
+				return
+			}
+			if err != nil && optional && ctx.Err() == nil {
+				logf(ctx, "Optional field %s unavailable, reporting 0: %v", name, err)
+				missingMu.Lock()
+				response.Missing = append(response.Missing, name)
+				missingMu.Unlock()
+				return
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+			*dst = value
+		}()
+	}
+
+	savings := config.SavingsEnabled && fields.Has("estimatedSavings")
+	flatSavings := savings && len(config.TariffWindows) == 0
+
+	// need holds the metrics to query: those requested plus the inputs of
+	// the values derived from them
+	need := make(map[string]bool)
+	for _, name := range []string{MetricGenerated, MetricConsumed, MetricExported, MetricImported, MetricDischarged, MetricMaxPv} {
+		need[name] = fields.Has(name)
+	}
+	if flatSavings {
+		need[MetricGenerated], need[MetricExported] = true, true
+	}
+	if fields.Has("surplus") {
+		need[MetricGenerated], need[MetricConsumed] = true, true
+	}
+	if fields.Has("performanceRatioPct") {
+		need[MetricGenerated] = true
+	}
+	if fields.Has("projectedDailyGenerated") && timeframe == "day" {
+		need[MetricGenerated] = true
+	}
+	if fields.Has("gridIndependencePct") || fields.Has("gridDependencePct") {
+		need[MetricConsumed], need[MetricImported] = true, true
+	}
+	roundTrip := fields.Has("batteryRoundTripPct")
+	if roundTrip {
+		need[MetricDischarged], need[MetricCharged] = true, true
+	}
+	if need[MetricMaxPv] && config.MinGenerationKWh > 0 {
+		need[MetricGenerated] = true
+	}
+	derivedConsumption := need[MetricConsumed] && config.ConsumptionMode != ConsumptionMeasured
+	if derivedConsumption {
+		need[MetricConsumed] = false
+		need[MetricGenerated], need[MetricImported], need[MetricDischarged], need[MetricExported] = true, true, true, true
+		need[MetricCharged] = need[MetricCharged] || config.ConsumptionMode == ConsumptionNet
+	}
+
+	var charged, soc float64
+	runtime := config.BatteryCapacityKWh > 0 && fields.Has("estimatedRuntimeMinutes")
+	if runtime {
+		run(&soc, instantQuery(MetricBatterySoc), false, MetricBatterySoc)
+		run(&response.loadKW, instantQuery(MetricLoadPower), false, MetricLoadPower)
+	}
+
+	targets := []struct {
+		name string
+		dst  *float64
+	}{
+		{MetricGenerated, &response.Generated},
+		{MetricConsumed, &response.Consumed},
+		{MetricExported, &response.Exported},
+		{MetricImported, &response.Imported},
+		{MetricDischarged, &response.Discharged},
+		{MetricMaxPv, &response.MaxPv},
+		{MetricCharged, &charged},
+	}
+
+	// COMBINED_QUERY fetches every plain metric in one round trip
+	var combined []string
+	if config.CombinedQuery && !config.DemoMode {
+		for _, t := range targets {
+			if need[t.name] && combinable(config, t.name) {
+				combined = append(combined, t.name)
+				need[t.name] = false
+			}
+		}
+	}
+	var combinedValues map[string]float64
+	if len(combined) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			values, err := queryCombined(queryCtx, client, config, timeframe, combined)
+			if err != nil && expired() {
+				unresolve(combined...)
+				return
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+			combinedValues = values
+		}()
+	}
+
+	for _, t := range targets {
+		if need[t.name] {
+			run(t.dst, metricQueryFor(t.name), config.Metrics[t.name].Optional, t.name)
+		}
+	}
+	if savings && !flatSavings {
+		run(&touSavings, queryTOUSavings, false, "estimatedSavings")
+	}
+	var extras []float64
+	if fields.Has("extra") {
+		extras = make([]float64, len(config.ExtraMeasurements))
+		for i, extra := range config.ExtraMeasurements {
+			run(&extras[i], extraQuery(extra), extra.Optional, "extra."+extra.Key)
+		}
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return Response{}, firstErr
+	}
+	slices.Sort(response.Missing)
+	if raw != nil {
+		response.Raw = raw.values
+	}
+	for _, t := range targets {
+		if value, ok := combinedValues[t.name]; ok {
+			*t.dst = value
+		}
+	}
+
+	// Values derived from an unresolved input are unresolved too
+	unresolved := func(names ...string) bool {
+		return slices.ContainsFunc(names, func(name string) bool { return slices.Contains(response.unresolved, name) })
+	}
+	if derivedConsumption && unresolved(MetricGenerated, MetricImported, MetricDischarged, MetricExported, MetricCharged) {
+		unresolve(MetricConsumed)
+	}
+	if unresolved(MetricGenerated, MetricConsumed) {
+		unresolve("surplus")
+	}
+	if unresolved(MetricConsumed, MetricImported) {
+		unresolve("gridIndependencePct", "gridDependencePct")
+	}
+	if roundTrip && unresolved(MetricDischarged, MetricCharged) {
+		unresolve("batteryRoundTripPct")
+	}
+	if flatSavings && unresolved(MetricGenerated, MetricExported) {
+		unresolve("estimatedSavings")
+	}
+	if unresolved(MetricGenerated) {
+		unresolve("projectedDailyGenerated", "performanceRatioPct")
+	}
+	if runtime && unresolved(MetricBatterySoc, MetricLoadPower) {
+		unresolve("estimatedRuntimeMinutes")
+	}
+	response.Partial = len(response.unresolved) > 0
+
+	// Dawn and dusk sensor noise isn't meaningful generation
+	if response.Generated < config.MinGenerationKWh && !unresolved(MetricGenerated) {
+		response.Generated = 0
+		response.MaxPv = 0
+	}
+
+	if derivedConsumption {
+		response.Consumed = deriveConsumption(config, response, charged)
+	}
+
+	if len(extras) > 0 {
+		response.Extra = make(map[string]float64, len(extras))
+		for i, extra := range config.ExtraMeasurements {
+			response.Extra[extra.Key] = extras[i]
+		}
+	}
+
+	if savings {
+		amount := touSavings
+		if flatSavings {
+			amount = estimateSavings(config, response)
+		}
+		response.EstimatedSavings = &amount
+		response.EstimatedSavingsFormatted = formatCurrency(config, amount)
+	}
+
+	if runtime {
+		response.batteryKWh = soc / 100 * config.BatteryCapacityKWh
+		response.EstimatedRuntimeMinutes = estimateRuntime(response.batteryKWh, response.loadKW)
 	}
 
-	return queryMeasurement(client, config, "lux_Etouser_day", start)
+	response.ResetGrace = timeframe == "day" && inResetGrace(config, config.now())
+	response.Warnings = append(dailyCounterWarnings(config, timeframe, fields), warnings.list()...)
+
+	// Everything above works in kWh; convert only for presentation
+	response.Generated = convertEnergy(config, response.Generated)
+	response.Consumed = convertEnergy(config, response.Consumed)
+	response.Exported = convertEnergy(config, response.Exported)
+	response.Imported = convertEnergy(config, response.Imported)
+	response.Discharged = convertEnergy(config, response.Discharged)
+	response.Surplus = response.Generated - response.Consumed
+	response.GridIndependencePct, response.GridDependencePct = gridReliance(response)
+	response.charged = convertEnergy(config, charged)
+	response.BatteryRoundTripPct = batteryRoundTrip(response)
+	response.ProjectedDailyGenerated = projectDaily(config, timeframe, response.Generated)
+	response.ExpectedGenerated, response.PerformanceRatioPct = clearSkyComparison(config, timeframe, response.Generated)
+	response.EnergyUnit = config.EnergyUnit
+
+	return response, nil
 }
 
-func queryMaxPv(client influxdb2.Client, config *Config, timeframe string) (float64, error) {
-	start, err := calculateRangeStart(timeframe)
-	if err != nil {
-		return 0, err
+// setCacheControl lets intermediary caches reuse a successful response for
+// as long as the configured max-age. Stale fallbacks are never cached.
+func setCacheControl(w http.ResponseWriter, config *Config, timeframe string, stale bool) {
+	if stale {
+		w.Header().Set("Cache-Control", "no-store")
+		return
 	}
 
-	watts, err := queryMeasurement(client, config, "lux_Pall", start)
-	if err != nil {
-		return 0, err
+	maxAge := config.cacheTTL(timeframe)
+	if config.CacheControlMaxAgeSet {
+		maxAge = config.CacheControlMaxAge
+	}
+	if maxAge > 0 || config.CacheControlMaxAgeSet {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+	}
+}
+
+// fetchResponse returns the Response for one timeframe from the cache or
+// InfluxDB, falling back to a stale cached copy when InfluxDB fails, and
+// applies the ?formatted and ?timing options.
+func fetchResponse(r *http.Request, backends []backend, config *Config, cache *responseCache, timeframe string, fields fieldSet) (Response, error) {
+	cacheKey := timeframe
+	if fields != nil {
+		cacheKey += "?fields=" + fields.key()
+	}
+	ctx := r.Context()
+	if r.URL.Query().Get("raw") == "true" {
+		cacheKey += "?raw"
+		ctx = withRawRequested(ctx)
+	}
+
+	timing := r.URL.Query().Get("timing") == "true"
+
+	var queryDuration time.Duration
+	var slow *slowQueries
+	response, ok := cache.Get(cacheKey)
+	if !ok {
+		query := func(queryCtx context.Context) (Response, error) {
+			if timing {
+				queryCtx, slow = withSlowQueries(queryCtx)
+			}
+			if config.QueryTimeout > 0 {
+				var cancel context.CancelFunc
+				queryCtx, cancel = context.WithTimeout(queryCtx, config.QueryTimeout)
+				defer cancel()
+			}
+			response, err := queryBackends(queryCtx, backends, config, timeframe, fields)
+			if err == nil && !response.Partial {
+				// Set before the flight ends, so no request slips in between
+				// and queries again
+				cache.Set(cacheKey, response, config.cacheTTL(timeframe))
+			}
+			return response, err
+		}
+
+		queryStart := time.Now()
+		var err error
+		if config.CoalesceQueries {
+			flightKey := cacheKey
+			if timing {
+				flightKey += "?timing"
+			}
+			// The shared queries outlive this request if it goes away
+			// while others still wait on them
+			response, err, _ = queryFlights.do(ctx, flightKey, func() (Response, error) {
+				return query(context.WithoutCancel(ctx))
+			})
+		} else {
+			response, err = query(ctx)
+		}
+		queryDuration = time.Since(queryStart)
+		if err != nil {
+			stale, ok := cache.GetStale(cacheKey)
+			if !ok {
+				return Response{}, err
+			}
+			logf(r.Context(), "Serving stale %s response: %v", timeframe, err)
+			response = stale
+			response.Stale = true
+		}
+	}
+
+	// cached serves the derived entry key from the cache, or populates it
+	// with fn like the main entry, coalesced under COALESCE_QUERIES
+	cached := func(key string, fn func(ctx context.Context) (Response, error)) (Response, error) {
+		if entry, ok := cache.Get(key); ok {
+			return entry, nil
+		}
+		populate := func(queryCtx context.Context) (Response, error) {
+			if config.QueryTimeout > 0 {
+				var cancel context.CancelFunc
+				queryCtx, cancel = context.WithTimeout(queryCtx, config.QueryTimeout)
+				defer cancel()
+			}
+			entry, err := fn(queryCtx)
+			if err == nil && !entry.Partial {
+				cache.Set(key, entry, config.cacheTTL(timeframe))
+			}
+			return entry, err
+		}
+		if !config.CoalesceQueries {
+			return populate(ctx)
+		}
+		entry, err, _ := queryFlights.do(ctx, key, func() (Response, error) {
+			return populate(context.WithoutCancel(ctx))
+		})
+		return entry, err
+	}
+
+	if r.URL.Query().Get("compare") == "true" {
+		previous, err := cached(cacheKey+"?previous", func(ctx context.Context) (Response, error) {
+			return queryPrevious(ctx, backends, config, timeframe, fields)
+		})
+		if err != nil {
+			return Response{}, err
+		}
+		response.Comparison = compareResponses(response, previous, fields)
+	}
+
+	if r.URL.Query().Get("average") == "daily" {
+		entry, err := cached(cacheKey+"?average", func(ctx context.Context) (Response, error) {
+			average, err := queryDailyAverage(ctx, backends, config, timeframe, fields)
+			return Response{DailyAverage: average}, err
+		})
+		if err != nil {
+			return Response{}, err
+		}
+		response.DailyAverage = entry.DailyAverage
+	}
+
+	if r.URL.Query().Get("counts") == "true" {
+		entry, err := cached(cacheKey+"?counts", func(ctx context.Context) (Response, error) {
+			counts, err := queryBackendCounts(ctx, backends, config, timeframe, fields)
+			return Response{Counts: counts}, err
+		})
+		if err != nil {
+			return Response{}, err
+		}
+		response.Counts = entry.Counts
+	}
+
+	if r.URL.Query().Get("profile") == "hourly" {
+		metric := r.URL.Query().Get("profileMetric")
+		if metric == "" {
+			metric = MetricGenerated
+		}
+		entry, err := cached(cacheKey+"?profile="+metric, func(ctx context.Context) (Response, error) {
+			profile, err := queryBackendProfile(ctx, backends, config, timeframe, metric)
+			return Response{Profile: profile}, err
+		})
+		if err != nil {
+			return Response{}, err
+		}
+		response.Profile = entry.Profile
+	}
+
+	if config.MaxDataAge > 0 {
+		queryCtx := ctx
+		if config.QueryTimeout > 0 {
+			var cancel context.CancelFunc
+			queryCtx, cancel = context.WithTimeout(ctx, config.QueryTimeout)
+			defer cancel()
+		}
+		if err := checkFreshness(queryCtx, backends, config, &response); err != nil {
+			return Response{}, err
+		}
 	}
 
-	return watts / 1000, nil
+	// A partial response would read as counters going backwards, so the
+	// client keeps its cursor until the next complete one
+	if r.URL.Query().Has("since") && !response.Partial {
+		if since := r.URL.Query().Get("since"); since != "" {
+			previous, err := parseCursor(since)
+			if err != nil {
+				return Response{}, err
+			}
+			response.Delta = deltaSince(config, response, fields, previous)
+		}
+		response.Cursor = newCursor(config, response, fields)
+	}
+
+	if r.URL.Query().Get("formatted") == "true" {
+		response.Formatted = formatResponse(config, response)
+	}
+
+	if timing {
+		ms := float64(queryDuration.Microseconds()) / 1000
+		response.QueryDurationMs = &ms
+		if slow != nil && len(slow.ms) > 0 {
+			response.SlowQueries = slow.ms
+		}
+	}
+
+	return response, nil
 }
 
-func handleSolarShowdown(client influxdb2.Client, config *Config) http.HandlerFunc {
+// validateOptions checks the /solarshowdown parameters that add derived
+// data to each timeframe's Response, for single and multiple timeframes
+// alike.
+func validateOptions(r *http.Request) error {
+	if v := r.URL.Query().Get("average"); v != "" && v != "daily" {
+		return fmt.Errorf("invalid average: %s", v)
+	}
+	if v := r.URL.Query().Get("profile"); v != "" && v != "hourly" {
+		return fmt.Errorf("invalid profile: %s", v)
+	}
+	if v := r.URL.Query().Get("profileMetric"); v != "" && !slices.Contains(profileMetrics, v) {
+		return fmt.Errorf("invalid profileMetric: %s", v)
+	}
+	return nil
+}
+
+func handleSolarShowdown(backends []backend, config *Config, cache *responseCache) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
+		switch {
+		case r.Method == http.MethodPost && config.AllowPost:
+			if err := paramsFromBody(w, r); err != nil {
+				writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, err)
+				return
+			}
+		case r.Method != http.MethodGet && r.Method != http.MethodHead:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
+		fields, err := parseFields(r.URL.Query().Get("fields"))
+		if err != nil {
+			writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, err)
+			return
+		}
+
+		if r.URL.Query().Has("since") {
+			if tf := r.URL.Query().Get("timeframe"); tf != "" && tf != "day" || r.URL.Query().Has("timeframes") || r.URL.Query().Has("month") {
+				writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, fmt.Errorf("since is only available with timeframe=day"))
+				return
+			}
+			if since := r.URL.Query().Get("since"); since != "" {
+				if _, err := parseCursor(since); err != nil {
+					writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, err)
+					return
+				}
+			}
+		}
+
+		if list := r.URL.Query().Get("timeframes"); list != "" {
+			if r.URL.Query().Has("timeframe") {
+				writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, fmt.Errorf("timeframe and timeframes are mutually exclusive"))
+				return
+			}
+			serveTimeframes(w, r, backends, config, cache, list, fields)
+			return
+		}
+
 		timeframe := r.URL.Query().Get("timeframe")
 		if timeframe == "" {
 			timeframe = "day" // Default timeframe
 		}
+		if month := r.URL.Query().Get("month"); month != "" {
+			if r.URL.Query().Has("timeframe") {
+				writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, fmt.Errorf("timeframe and month are mutually exclusive"))
+				return
+			}
+			if _, ok := calendarMonth(month); !ok {
+				writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, fmt.Errorf("invalid month: %s, expected YYYY-MM", month))
+				return
+			}
+			if _, _, err := calculateRange(config, month); err != nil {
+				writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, err)
+				return
+			}
+			timeframe = month
+		}
 
-		generated, err := queryGenerated(client, config, timeframe)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(Response{Error: err.Error()})
+		if _, _, err := calculateRange(config, timeframe); err != nil {
+			writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidTimeframe, err)
 			return
 		}
-
-		consumed, err := queryConsumed(client, config, timeframe)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(Response{Error: err.Error()})
+		if !config.timeframeAllowed(timeframe) {
+			writeResponseError(w, http.StatusForbidden, ErrorCodeTimeframeNotAllowed, fmt.Errorf("timeframe not allowed: %s", timeframe))
 			return
 		}
 
-		exported, err := queryExported(client, config, timeframe)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(Response{Error: err.Error()})
+		if err := validateOptions(r); err != nil {
+			writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, err)
 			return
 		}
 
-		imported, err := queryImported(client, config, timeframe)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(Response{Error: err.Error()})
+		format := r.URL.Query().Get("format")
+		switch format {
+		case "", "json", "hass":
+		case "influx-csv":
+			if config.DemoMode {
+				writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, fmt.Errorf("influx-csv is not available in demo mode"))
+				return
+			}
+			serveInfluxCSV(w, r, backends, timeframe)
+			return
+		default:
+			writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, fmt.Errorf("invalid format: %s", format))
 			return
 		}
 
-		discharged, err := queryDischarged(client, config, timeframe)
+		response, err := fetchResponse(r, backends, config, cache, timeframe, fields)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(Response{Error: err.Error()})
+			writeResponseError(w, errorStatus(err), errorCode(err), err)
 			return
 		}
 
-		maxPv, err := queryMaxPv(client, config, timeframe)
+		// A partial response is never cached, so must not be reused downstream
+		setCacheControl(w, config, timeframe, response.Stale || response.Partial || response.DataStale)
+		status := http.StatusOK
+		if response.Partial {
+			status = http.StatusPartialContent
+		}
+		if response.DataStale && config.StaleDataError {
+			status = http.StatusServiceUnavailable
+			response.Error, response.ErrorCode = dataStaleError(config), ErrorCodeDataStale
+		}
+
+		if r.Method == http.MethodHead {
+			// Monitoring probes only need the status and headers
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			return
+		}
+		if format == "hass" {
+			writeJSON(w, status, hassResponse(config, timeframe, response, fields))
+			return
+		}
+		body, err := encodeResponse(config, response, fields)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(Response{Error: err.Error()})
+			writeResponseError(w, http.StatusInternalServerError, ErrorCodeQueryFailed, err)
 			return
 		}
+		writeJSON(w, status, body)
+	}
+}
 
-		response := Response{
-			Generated:  generated,
-			Consumed:   consumed,
-			Exported:   exported,
-			Imported:   imported,
-			Discharged: discharged,
-			MaxPv:      maxPv,
-		}
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+type NotFoundResponse struct {
+	Error     string   `json:"error"`
+	ErrorCode string   `json:"errorCode"`
+	Routes    []string `json:"routes"`
+}
+
+// handleNotFound answers every unregistered path with a JSON 404 listing the
+// available routes, in place of the default mux's plain-text response.
+func handleNotFound(routes []route) http.HandlerFunc {
+	patterns := make([]string, len(routes))
+	for i, rt := range routes {
+		patterns[i] = rt.pattern
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusNotFound, NotFoundResponse{
+			Error:     fmt.Sprintf("no route for %s", r.URL.Path),
+			ErrorCode: ErrorCodeNotFound,
+			Routes:    patterns,
+		})
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+// redact hides a secret in logs while still showing whether it is set.
+func redact(secret string) string {
+	if secret == "" {
+		return "(unset)"
+	}
+	return "(redacted)"
+}
+
+// logConfig logs the resolved configuration so misconfigurations such as a
+// wrong bucket are visible at boot. Tokens are never logged.
+func logConfig(config *Config) {
+	log.Printf("Config: server_port=%s influxdb_version=%s energy_unit=%s timeframes=%s user_agent=%s",
+		config.ServerPort, config.InfluxDBVersion, config.EnergyUnit, strings.Join(timeframes, ","), config.UserAgent)
+	for i, b := range config.Backends {
+		log.Printf("Config: backend[%d] url=%s org=%s bucket=%s dongles=%s token=%s",
+			i, b.URL, b.Org, b.Bucket, strings.Join(b.Dongles, ","), redact(b.Token))
+	}
+	if config.Clock != nil {
+		log.Printf("Config: clock pinned at %s", config.now().Format(time.RFC3339))
+	}
+	if config.WebhookURL != "" {
+		log.Printf("Config: webhook timeframe=%s next=%s",
+			config.WebhookTimeframe, config.WebhookSchedule.next(time.Now()).Format(time.RFC3339))
+	}
+	log.Printf("Config: max_concurrent_queries=%d query_timeout=%s daily_max_days=%d",
+		config.MaxConcurrentQueries, config.QueryTimeout, config.DailyMaxDays)
+	for _, timeframe := range timeframes {
+		log.Printf("Config: cache_ttl[%s]=%s", timeframe, config.CacheTTLs[timeframe])
+	}
+	log.Printf("Config: cache_max_entries=%d serve_stale_max_age=%s admin_token=%s",
+		config.CacheMaxEntries, config.ServeStaleMaxAge, redact(config.AdminToken))
+	if config.SavingsEnabled {
+		log.Printf("Config: savings import_rate=%g export_rate=%g tariff_windows=%d currency=%s",
+			config.ImportRate, config.ExportRate, len(config.TariffWindows), config.CurrencySymbol)
+	}
+	for _, extra := range config.ExtraMeasurements {
+		log.Printf("Config: extra %s=%s:%s", extra.Key, extra.Measurement, extra.Aggregation)
 	}
 }
 
 func main() {
+	var file *configFile
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		file = &configFile{path: path}
+		if err := file.apply(); err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+	}
+
 	config, err := loadConfig()
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	logConfig(config)
+
+	if config.MaxConcurrentQueries > 0 {
+		querySlots = make(chan struct{}, config.MaxConcurrentQueries)
+	}
+
+	cache := newResponseCache(config.ServeStaleMaxAge, config.CacheMaxEntries)
 
-	// Create InfluxDB client
-	client := influxdb2.NewClient(config.InfluxDBURL, config.InfluxDBToken)
-	defer client.Close()
+	// Readiness carries over reloads, since they reuse the same InfluxDB
+	var wu *warmup
+	warm := func(backends []backend) *warmup {
+		if wu == nil {
+			wu = startWarmup(backends, config)
+		}
+		return wu
+	}
 
-	// Set up routes
-	http.HandleFunc("/solarshowdown", handleSolarShowdown(client, config))
+	var current atomic.Pointer[server]
+	current.Store(newServer(config, cache, warm))
+	go reloadOnHangup(file, &current, cache, warm)
 
 	// Start server
-	log.Printf("Starting server on port %s", config.ServerPort)
-	if err := http.ListenAndServe(":"+config.ServerPort, nil); err != nil {
+	log.Printf("Starting server on %s", config.listenAddress())
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current.Load().handler.ServeHTTP(w, r)
+	})
+	if err := http.ListenAndServe(config.listenAddress(), handler); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+)
+
+// queryResult wraps annotated CSV rows, as InfluxDB answers a Flux query,
+// in a QueryTableResult.
+func queryResult(rows string) *api.QueryTableResult {
+	return api.NewQueryTableResult(io.NopCloser(queryResultCSV(rows)))
+}
+
+func queryResultCSV(rows string) io.Reader {
+	csv := "#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,double,string\n" +
+		"#group,false,false,true,true,false,true\n" +
+		"#default,_result,,,,,\n" +
+		",result,table,_start,_stop,_value,_measurement\n" +
+		rows + "\n"
+	return strings.NewReader(csv)
+}
+
+// fakeInfluxDB serves Flux queries with answer, which returns the
+// annotated CSV rows for a query, and returns a client of it.
+func fakeInfluxDB(t *testing.T, answer func(query string) string) influxdb2.Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Query string `json:"query"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		rows, _ := io.ReadAll(queryResultCSV(answer(body.Query)))
+		w.Write(rows)
+	}))
+	t.Cleanup(server.Close)
+
+	client := influxdb2.NewClient(server.URL, "token")
+	t.Cleanup(client.Close)
+	return client
+}
+
+// testConfig is a minimal Config for querying a fakeInfluxDB.
+func testConfig() *Config {
+	return &Config{
+		InfluxDBOrg:    "org",
+		InfluxDBBucket: "solar",
+		Dongle:         "BA12345678",
+		TagKey:         "dongle",
+		ValueField:     "value",
+		Metrics:        defaultMetricSources(),
+		RangePrecision: time.Minute,
+	}
+}
+
+func TestReadQueryResult(t *testing.T) {
+	tests := []struct {
+		name      string
+		rows      string
+		value     float64
+		found     bool
+		wantError bool
+	}{
+		{
+			name:  "single series",
+			rows:  ",,0,2024-01-01T00:00:00Z,2024-01-02T00:00:00Z,7.5,lux_Epv1_day",
+			value: 7.5,
+			found: true,
+		},
+		{
+			name: "several series",
+			rows: ",,0,2024-01-01T00:00:00Z,2024-01-02T00:00:00Z,7.5,lux_Epv1_day\n" +
+				",,1,2024-01-01T00:00:00Z,2024-01-02T00:00:00Z,3.2,lux_Epv1_day",
+			found:     true,
+			wantError: true,
+		},
+		{
+			name: "no series",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, found, err := readQueryResult(&Config{}, queryResult(tt.rows), "lux_Epv1_day")
+			if (err != nil) != tt.wantError {
+				t.Fatalf("got error %v, want error %v", err, tt.wantError)
+			}
+			if value != tt.value || found != tt.found {
+				t.Errorf("got %v, %v; want %v, %v", value, found, tt.value, tt.found)
+			}
+		})
+	}
+}
+
+func TestNumericValueNonFinite(t *testing.T) {
+	tests := []struct {
+		name  string
+		value float64
+	}{
+		{"NaN", math.NaN()},
+		{"+Inf", math.Inf(1)},
+		{"-Inf", math.Inf(-1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := numericValue(&Config{}, tt.value, "lux_Pall")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != 0 {
+				t.Errorf("got %v, want 0", got)
+			}
+		})
+	}
+}
+
+func TestNumericValueStrings(t *testing.T) {
+	tests := []struct {
+		name      string
+		lenient   bool
+		value     string
+		want      float64
+		wantError bool
+	}{
+		{name: "numeric string", lenient: true, value: " 12.5 ", want: 12.5},
+		{name: "non-numeric string", lenient: true, value: "n/a", wantError: true},
+		{name: "numeric string without LENIENT_TYPES", value: "12.5", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := numericValue(&Config{LenientTypes: tt.lenient}, tt.value, "lux_Epv1_day")
+			if (err != nil) != tt.wantError {
+				t.Fatalf("got error %v, want error %v", err, tt.wantError)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValueFieldSelectsField(t *testing.T) {
+	// lux_Epv1_day has a value and a power field; answer with whichever the
+	// query filters on
+	fields := map[string]float64{"value": 7.5, "power": 2.25}
+	client := fakeInfluxDB(t, func(query string) string {
+		var rows []string
+		for field, v := range fields {
+			if strings.Contains(query, fmt.Sprintf(`r["_field"] == "%s"`, field)) {
+				rows = append(rows, fmt.Sprintf(",,%d,2024-01-01T00:00:00Z,2024-01-02T00:00:00Z,%g,lux_Epv1_day", len(rows), v))
+			}
+		}
+		return strings.Join(rows, "\n")
+	})
+
+	override := testConfig()
+	DongleOverride{ValueField: "power"}.apply(override)
+	tests := []struct {
+		name       string
+		valueField string
+		config     *Config
+		want       float64
+	}{
+		{name: "default", config: testConfig(), want: 7.5},
+		{name: "VALUE_FIELD", valueField: "power", config: testConfig(), want: 2.25},
+		{name: "dongle override", config: override, want: 2.25},
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.valueField != "" {
+				tt.config.ValueField = tt.valueField
+			}
+			got, err := queryAggregate(context.Background(), client, tt.config, "lux_Epv1_day", "max", start, start.AddDate(0, 0, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalculateRangePrecision(t *testing.T) {
+	now := time.Date(2024, 6, 21, 15, 4, 5, 600_000_000, time.UTC)
+	tests := []struct {
+		timeframe string
+		precision time.Duration
+		want      time.Time
+	}{
+		{"week", 0, time.Date(2024, 6, 14, 15, 4, 5, 600_000_000, time.UTC)},
+		{"week", time.Second, time.Date(2024, 6, 14, 15, 4, 5, 0, time.UTC)},
+		{"week", time.Minute, time.Date(2024, 6, 14, 15, 4, 0, 0, time.UTC)},
+		{"week", time.Hour, time.Date(2024, 6, 14, 15, 0, 0, 0, time.UTC)},
+		{"month", 0, time.Date(2024, 5, 21, 15, 4, 5, 600_000_000, time.UTC)},
+		{"month", time.Second, time.Date(2024, 5, 21, 15, 4, 5, 0, time.UTC)},
+		{"month", time.Minute, time.Date(2024, 5, 21, 15, 4, 0, 0, time.UTC)},
+		{"month", time.Hour, time.Date(2024, 5, 21, 15, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s", tt.timeframe, tt.precision), func(t *testing.T) {
+			config := &Config{Clock: func() time.Time { return now }, RangePrecision: tt.precision}
+			start, _, err := calculateRange(config, tt.timeframe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !start.Equal(tt.want) {
+				t.Errorf("got start %s, want %s", start, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalculateRangeFrozenClock(t *testing.T) {
+	now := time.Date(2024, 6, 21, 15, 0, 0, 0, time.Local)
+	today := time.Date(2024, 6, 21, 0, 1, 0, 0, time.Local).UTC()
+	yesterday := time.Date(2024, 6, 20, 0, 1, 0, 0, time.Local).UTC()
+	tests := []struct {
+		timeframe   string
+		start, stop time.Time
+	}{
+		// A frozen clock also closes the open ranges at its time
+		{"day", today, now.UTC()},
+		{"yesterday", yesterday, today},
+		{"week", now.AddDate(0, 0, -7).UTC(), now.UTC()},
+		{"month", now.AddDate(0, -1, 0).UTC(), now.UTC()},
+	}
+
+	config := &Config{Clock: func() time.Time { return now }, RangePrecision: time.Minute}
+	for _, tt := range tests {
+		t.Run(tt.timeframe, func(t *testing.T) {
+			start, stop, err := calculateRange(config, tt.timeframe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !start.Equal(tt.start) || !stop.Equal(tt.stop) {
+				t.Errorf("got [%s, %s), want [%s, %s)", start, stop, tt.start, tt.stop)
+			}
+		})
+	}
+
+	if _, _, err := calculateRange(config, "2024-07"); err == nil {
+		t.Error("got no error for a month after the frozen clock")
+	}
+}
+
+func TestErrorResponsesAreJSON(t *testing.T) {
+	// InfluxDB failing every query
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code":"internal error","message":"boom"}`, http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	client := influxdb2.NewClient(server.URL, "token")
+	defer client.Close()
+
+	config := testConfig()
+	handler := handleSolarShowdown([]backend{{client: client, config: config}}, config, newResponseCache(0, 0))
+	serve := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	// InfluxDB answering, but with nothing written within MAX_DATA_AGE
+	stale := testConfig()
+	stale.MaxDataAge, stale.StaleDataError = time.Hour, true
+	staleClient := fakeInfluxDB(t, func(query string) string {
+		if strings.Contains(query, "last()") {
+			return ""
+		}
+		return ",,0,2024-01-01T00:00:00Z,2024-01-02T00:00:00Z,4.5,lux_Epv1_day"
+	})
+	staleRec := httptest.NewRecorder()
+	handleSolarShowdown([]backend{{client: staleClient, config: stale}}, stale, newResponseCache(0, 0))(
+		staleRec, httptest.NewRequest(http.MethodGet, "/solarshowdown?timeframes=day,week&fields=generated", nil))
+
+	gateway := httptest.NewRecorder()
+	writeResponseError(gateway, http.StatusBadGateway, ErrorCodeBackendUnavailable, fmt.Errorf("backend failed"))
+
+	tests := []struct {
+		name   string
+		rec    *httptest.ResponseRecorder
+		status int
+	}{
+		{"invalid timeframe", serve("/solarshowdown?timeframe=fortnight"), http.StatusBadRequest},
+		{"backend failure", serve("/solarshowdown?fields=generated"), http.StatusInternalServerError},
+		{"bad gateway", gateway, http.StatusBadGateway},
+		{"stale data across timeframes", staleRec, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.rec.Code != tt.status {
+				t.Errorf("got status %d, want %d", tt.rec.Code, tt.status)
+			}
+			if got := tt.rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("got Content-Type %q, want application/json", got)
+			}
+			var body Response
+			if err := json.Unmarshal(tt.rec.Body.Bytes(), &body); err != nil || body.ErrorCode == "" {
+				t.Errorf("got body %q, want a JSON error with an errorCode", tt.rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// Names of the Response metrics, as used in MEASUREMENT_MAP.
+const (
+	MetricGenerated  = "generated"
+	MetricConsumed   = "consumed"
+	MetricExported   = "exported"
+	MetricImported   = "imported"
+	MetricDischarged = "discharged"
+	MetricMaxPv      = "maxPv"
+
+	// MetricCharged is the energy put into the battery. It isn't reported
+	// itself but feeds CONSUMPTION_MODE=net.
+	MetricCharged = "charged"
+
+	// MetricBatterySoc (percent) and MetricLoadPower (kW) are the latest
+	// instantaneous readings behind the battery runtime estimate.
+	MetricBatterySoc = "batterySoc"
+	MetricLoadPower  = "loadPower"
+)
+
+// Values for CONSUMPTION_MODE. All terms are daily-counter energies, each
+// non-negative, so the derived modes can't go negative unless the
+// counters disagree.
+const (
+	// ConsumptionMeasured reports the inverter's own consumption counter.
+	ConsumptionMeasured = "measured"
+	// ConsumptionNet is the household load: everything that flowed in
+	// (generated + imported + discharged) less what left without being used
+	// (exported + charged).
+	ConsumptionNet = "net"
+	// ConsumptionGross is the same balance without subtracting charged, so
+	// energy the battery absorbed counts as consumed.
+	ConsumptionGross = "gross"
+)
+
+// MetricSource describes where a Response metric comes from: each
+// measurement is reduced with Aggregation, the results are summed, and the
+// sum is multiplied by Scale to reach kWh (kW for maxPv). An Optional
+// metric whose query fails is reported as 0 instead of failing the request.
+type MetricSource struct {
+	Measurements []string `json:"measurements"`
+	Aggregation  string   `json:"aggregation"`
+	Scale        float64  `json:"scale"`
+	Optional     bool     `json:"optional"`
+}
+
+// defaultMetricSources maps the metrics onto LuxPower/EG4 measurements.
+func defaultMetricSources() map[string]MetricSource {
+	return map[string]MetricSource{
+		MetricGenerated:  {Measurements: []string{"lux_Epv1_day", "lux_Epv2_day", "lux_Epv3_day"}, Aggregation: "max", Scale: 1},
+		MetricConsumed:   {Measurements: []string{"lux_DailyConsumption"}, Aggregation: "max", Scale: 0.001}, // Stored in Wh
+		MetricExported:   {Measurements: []string{"lux_Etogrid_day"}, Aggregation: "max", Scale: 1},
+		MetricImported:   {Measurements: []string{"lux_Etouser_day"}, Aggregation: "max", Scale: 1},
+		MetricDischarged: {Measurements: []string{"lux_Edischg_day"}, Aggregation: "max", Scale: 1},
+		MetricMaxPv:      {Measurements: []string{"lux_Pall"}, Aggregation: "max", Scale: 0.001}, // Stored in W
+		MetricCharged:    {Measurements: []string{"lux_Echg_day"}, Aggregation: "max", Scale: 1},
+		MetricBatterySoc: {Measurements: []string{"lux_SOC"}, Aggregation: "last", Scale: 1},
+		MetricLoadPower:  {Measurements: []string{"lux_ConsumptionPower"}, Aggregation: "last", Scale: 0.001}, // Stored in W
+	}
+}
+
+// parseMeasurementMap overlays MEASUREMENT_MAP, a JSON object keyed by
+// metric name, onto the defaults. Omitted metrics keep their defaults and
+// omitted aggregation and scale default to "max" and 1.
+func parseMeasurementMap(spec string) (map[string]MetricSource, error) {
+	var overrides map[string]MetricSource
+	if err := json.Unmarshal([]byte(spec), &overrides); err != nil {
+		return nil, fmt.Errorf("invalid MEASUREMENT_MAP: %v", err)
+	}
+	return overlayMetricSources(defaultMetricSources(), overrides, "MEASUREMENT_MAP")
+}
+
+// overlayMetricSources returns a copy of sources with overrides applied,
+// validated as MEASUREMENT_MAP entries and reported under setting.
+func overlayMetricSources(sources, overrides map[string]MetricSource, setting string) (map[string]MetricSource, error) {
+	sources = maps.Clone(sources)
+	for name, source := range overrides {
+		if _, ok := sources[name]; !ok {
+			return nil, fmt.Errorf("invalid %s: unknown metric %q", setting, name)
+		}
+		if len(source.Measurements) == 0 {
+			return nil, fmt.Errorf("invalid %s: %s has no measurements", setting, name)
+		}
+		if source.Aggregation == "" {
+			source.Aggregation = "max"
+		}
+		if !extraAggregations[source.Aggregation] {
+			return nil, fmt.Errorf("invalid %s: %s has unsupported aggregation %q", setting, name, source.Aggregation)
+		}
+		if source.Scale == 0 {
+			source.Scale = 1
+		}
+		sources[name] = source
+	}
+
+	return sources, nil
+}
+
+// parseDownsampledMeasurements parses DOWNSAMPLED_MEASUREMENTS, a JSON
+// object mapping timeframes to MEASUREMENT_MAP-style overrides read for them
+// instead, such as pre-aggregated daily measurements written by a Flux
+// task. An omitted aggregation defaults to "sum", totalling the periods.
+func parseDownsampledMeasurements(spec string, sources map[string]MetricSource) (map[string]map[string]MetricSource, error) {
+	var downsampled map[string]map[string]MetricSource
+	if err := json.Unmarshal([]byte(spec), &downsampled); err != nil {
+		return nil, fmt.Errorf("invalid DOWNSAMPLED_MEASUREMENTS: %v", err)
+	}
+
+	for timeframe, overrides := range downsampled {
+		if !slices.Contains(timeframes, timeframe) {
+			return nil, fmt.Errorf("invalid DOWNSAMPLED_MEASUREMENTS: unknown timeframe %q", timeframe)
+		}
+		for name, source := range overrides {
+			if _, ok := sources[name]; !ok {
+				return nil, fmt.Errorf("invalid DOWNSAMPLED_MEASUREMENTS: unknown metric %q", name)
+			}
+			if len(source.Measurements) == 0 {
+				return nil, fmt.Errorf("invalid DOWNSAMPLED_MEASUREMENTS: %s.%s has no measurements", timeframe, name)
+			}
+			if source.Aggregation == "" {
+				source.Aggregation = "sum"
+			}
+			if !extraAggregations[source.Aggregation] {
+				return nil, fmt.Errorf("invalid DOWNSAMPLED_MEASUREMENTS: %s.%s has unsupported aggregation %q", timeframe, name, source.Aggregation)
+			}
+			if source.Scale == 0 {
+				source.Scale = 1
+			}
+			overrides[name] = source
+		}
+	}
+
+	return downsampled, nil
+}
+
+// downsampledConfig returns config with the DOWNSAMPLED_MEASUREMENTS of
+// timeframe swapped in, or config itself when it has none.
+func downsampledConfig(config *Config, timeframe string) *Config {
+	overrides, ok := config.Downsampled[timeframeClass(timeframe)]
+	if !ok {
+		return config
+	}
+
+	c := *config
+	c.Metrics = maps.Clone(config.Metrics)
+	for name, source := range overrides {
+		c.Metrics[name] = source
+	}
+	if _, ok := overrides[MetricMaxPv]; ok {
+		// The downsampled source replaces the live per-string power too
+		c.PvPowerStrings = nil
+	}
+	return &c
+}
+
+// counterMetrics are the metrics read from daily counters that reset at
+// local midnight.
+var counterMetrics = []string{MetricGenerated, MetricConsumed, MetricExported, MetricImported, MetricDischarged, MetricCharged}
+
+// metricAggregation is the aggregation used for metric over [start, stop).
+// With DAY_START_HOUR a single day's window spans the counters' midnight
+// reset, so their max is replaced by their increase over it; longer windows
+// keep the configured aggregation.
+func metricAggregation(config *Config, metric string, start, stop time.Time) string {
+	source := config.Metrics[metric]
+	if config.DayStartHour != 0 && source.Aggregation == "max" && slices.Contains(counterMetrics, metric) && singleDay(config, start, stop) {
+		return "increase"
+	}
+	return source.Aggregation
+}
+
+// singleDay reports whether [start, stop) covers at most one day, allowing
+// for DST days and the reset offset. A zero stop means now.
+func singleDay(config *Config, start, stop time.Time) bool {
+	if stop.IsZero() {
+		stop = config.now()
+	}
+	return stop.Sub(start) <= 25*time.Hour
+}
+
+// queryMetricRange computes a metric over [start, stop) from its configured
+// source.
+func queryMetricRange(ctx context.Context, client influxdb2.Client, config *Config, metric string, start, stop time.Time) (float64, error) {
+	if config.DemoMode {
+		return demoMetricRange(config, metric, start, stop), nil
+	}
+
+	source := config.Metrics[metric]
+	var total float64
+	if metric == MetricMaxPv && len(config.PvPowerStrings) > 0 {
+		peak, err := queryPvStringsPeak(ctx, client, config, start, stop)
+		if err != nil {
+			return 0, err
+		}
+		total = peak
+	} else {
+		values := make([]float64, 0, len(source.Measurements))
+		for _, measurement := range source.Measurements {
+			value, err := queryAggregate(ctx, client, config, measurement, metricAggregation(config, metric, start, stop), start, stop)
+			if err != nil {
+				return 0, err
+			}
+			total += value
+			values = append(values, value*source.Scale)
+		}
+		if _, ok := config.DailyCeilings[metric]; ok {
+			return applyCeiling(ctx, config, metric, values, rangeCeiling(config, metric, start, stop)), nil
+		}
+	}
+
+	// Only a glitch exceeds the cap, so the filtered query runs only then
+	if metric == MetricMaxPv && config.MaxPvCapKW > 0 && total*source.Scale > config.MaxPvCapKW && config.valueCeiling == 0 {
+		logf(ctx, "maxPv of %.1f kW exceeds MAX_PV_CAP of %.1f kW, discarding the readings above it", total*source.Scale, config.MaxPvCapKW)
+		capped := *config
+		capped.valueCeiling = config.MaxPvCapKW / source.Scale
+		return queryMetricRange(ctx, client, &capped, metric, start, stop)
+	}
+
+	return total * source.Scale, nil
+}
+
+// ceilingFilter returns the Flux filter dropping values above
+// config.valueCeiling, or nothing when no ceiling is set.
+func ceilingFilter(config *Config) string {
+	if config.valueCeiling == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n\t\t\t|> filter(fn: (r) => r[\"_value\"] <= %g)", config.valueCeiling)
+}
+
+// queryPvStringsPeak returns the peak of the summed PV_POWER_STRINGS power
+// over [start, stop). Each string is averaged per minute so samples line up
+// before they're summed; summing each string's own max would overstate the
+// peak when the strings peak at different times.
+func queryPvStringsPeak(ctx context.Context, client influxdb2.Client, config *Config, start, stop time.Time) (float64, error) {
+	queryAPI := client.QueryAPI(config.InfluxDBOrg)
+	query := pvStringsPeakQuery(config, start, stop)
+
+	if err := acquireQuerySlot(ctx); err != nil {
+		return 0, fmt.Errorf("waiting to query PV string power: %w", err)
+	}
+	defer releaseQuerySlot()
+	defer observeQuery(ctx, config, "PV string power", time.Now())
+
+	result, err := queryAPI.Query(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("query failed for PV string power: %w", err)
+	}
+	defer result.Close()
+
+	value, err := processQueryResult(config, result, "PV string power")
+	if err != nil {
+		return 0, fmt.Errorf("reading result for PV string power: %w", err)
+	}
+
+	return value, nil
+}
+
+// pvStringsPeakQuery builds the Flux query of queryPvStringsPeak.
+func pvStringsPeakQuery(config *Config, start, stop time.Time) string {
+	return fmt.Sprintf(`
+		from(bucket:"%[1]s")
+			|> range(%[2]s)
+			|> %[3]s
+			|> filter(fn: (r) => r["%[5]s"] == "%[4]s")
+			|> aggregateWindow(every: 1m, fn: mean, createEmpty: false)
+			|> group(columns: ["_time"])
+			|> sum()%[6]s
+			|> group()
+			|> max()`,
+		config.InfluxDBBucket,
+		fluxRange(start, stop),
+		seriesFilter(config, config.PvPowerStrings...),
+		config.Dongle,
+		config.TagKey,
+		ceilingFilter(config))
+}
+
+// deriveConsumption computes Consumed from the other metrics for the net and
+// gross consumption modes. charged is only used by net.
+func deriveConsumption(config *Config, response Response, charged float64) float64 {
+	consumed := response.Generated + response.Imported + response.Discharged - response.Exported
+	if config.ConsumptionMode == ConsumptionNet {
+		consumed -= charged
+	}
+	return consumed
+}
+
+// metricQueryFor returns a metricQuery computing metric over a timeframe.
+func metricQueryFor(metric string) metricQuery {
+	return func(ctx context.Context, client influxdb2.Client, config *Config, timeframe string) (float64, error) {
+		start, stop, err := calculateRange(config, timeframe)
+		if err != nil {
+			return 0, err
+		}
+
+		return queryMetricRange(ctx, client, config, metric, start, stop)
+	}
+}
+
+// dailyCounterWarnings explains when a timeframe spans more than one daily
+// counter reset: taking the max of a "_day" counter over several days yields
+// only the single largest day rather than the total.
+func dailyCounterWarnings(config *Config, timeframe string, fields fieldSet) []string {
+	start, stop, err := calculateRange(config, timeframe)
+	if err != nil || config.DemoMode || singleDay(config, start, stop) {
+		// Demo data is summed across days
+		return nil
+	}
+
+	var warnings []string
+	for _, metric := range []string{MetricGenerated, MetricConsumed, MetricExported, MetricImported, MetricDischarged} {
+		if !fields.Has(metric) {
+			continue
+		}
+		source := config.Metrics[metric]
+		daily := slices.ContainsFunc(source.Measurements, func(m string) bool {
+			return strings.HasSuffix(m, "_day")
+		})
+		if daily && source.Aggregation == "max" {
+			warnings = append(warnings, fmt.Sprintf(
+				"%s is the max of a daily counter over a %s timeframe, so it is likely a single day's total rather than the sum across the period",
+				metric, timeframe))
+		}
+	}
+
+	return warnings
+}
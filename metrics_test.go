@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetricAggregationDayStartHour(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		timeframe    string
+		dayStartHour int
+		want         string
+	}{
+		{"day", 0, "max"},
+		{"day", 6, "increase"},
+		{"yesterday", 6, "increase"},
+		{"week", 6, "max"},
+		{"isoweek", 6, "max"},
+		{"month", 6, "max"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.timeframe, func(t *testing.T) {
+			config := testConfig()
+			config.Clock = func() time.Time { return now }
+			config.DayStartHour = tt.dayStartHour
+			start, stop, err := calculateRange(config, tt.timeframe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := metricAggregation(config, MetricGenerated, start, stop); got != tt.want {
+				t.Errorf("DAY_START_HOUR=%d: got %s, want %s", tt.dayStartHour, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// defaultMeasurementPrefix is the prefix of the default LuxPower/EG4
+// measurement names, which MeasurementPrefix replaces.
+const defaultMeasurementPrefix = "lux_"
+
+// DongleOverride replaces global settings for one dongle of a mixed fleet.
+// Unset fields keep the global value.
+type DongleOverride struct {
+	// ValueField replaces VALUE_FIELD.
+	ValueField string `json:"valueField"`
+	// MeasurementPrefix replaces the "lux_" prefix of every measurement
+	// name, after MeasurementMap is applied.
+	MeasurementPrefix string `json:"measurementPrefix"`
+	// MeasurementMap is overlaid on the global metric sources like
+	// MEASUREMENT_MAP.
+	MeasurementMap map[string]MetricSource `json:"measurementMap"`
+	// PvStringCount reads generated from lux_Epv1_day to lux_EpvN_day,
+	// unless MeasurementMap sets generated itself.
+	PvStringCount int `json:"pvStringCount"`
+	// PvPowerStrings replaces PV_POWER_STRINGS.
+	PvPowerStrings []string `json:"pvPowerStrings"`
+	// PowerDivisor converts the stored power readings (maxPv and loadPower)
+	// to kW, e.g. 1000 for W; it replaces their scale.
+	PowerDivisor float64 `json:"powerDivisor"`
+}
+
+// parseDongleOverrides parses DONGLE_OVERRIDES, a JSON object of
+// DongleOverride keyed by dongle. Every key must be a configured dongle.
+func parseDongleOverrides(spec string, backends []BackendConfig) (map[string]DongleOverride, error) {
+	var overrides map[string]DongleOverride
+	if err := json.Unmarshal([]byte(spec), &overrides); err != nil {
+		return nil, fmt.Errorf("invalid DONGLE_OVERRIDES: %v", err)
+	}
+
+	for dongle, override := range overrides {
+		if !slices.ContainsFunc(backends, func(b BackendConfig) bool { return slices.Contains(b.Dongles, dongle) }) {
+			return nil, fmt.Errorf("invalid DONGLE_OVERRIDES: %q is not a configured dongle", dongle)
+		}
+		if strings.ContainsAny(override.ValueField, `"\`) {
+			return nil, fmt.Errorf("invalid DONGLE_OVERRIDES: %s has invalid valueField %q", dongle, override.ValueField)
+		}
+		if override.PvStringCount < 0 || override.PowerDivisor < 0 {
+			return nil, fmt.Errorf("invalid DONGLE_OVERRIDES: %s has a negative pvStringCount or powerDivisor", dongle)
+		}
+		if _, err := overlayMetricSources(defaultMetricSources(), override.MeasurementMap, "DONGLE_OVERRIDES "+dongle); err != nil {
+			return nil, err
+		}
+	}
+	return overrides, nil
+}
+
+// apply overrides the settings of config, a backend's own copy of the
+// global Config.
+func (o DongleOverride) apply(config *Config) {
+	if o.ValueField != "" {
+		config.ValueField = o.ValueField
+	}
+
+	// Validated by parseDongleOverrides; the overlay also copies the map
+	// shared with the global Config
+	metrics, _ := overlayMetricSources(config.Metrics, o.MeasurementMap, "DONGLE_OVERRIDES")
+	if o.PvStringCount > 0 && o.MeasurementMap[MetricGenerated].Measurements == nil {
+		generated := metrics[MetricGenerated]
+		generated.Measurements = nil
+		for i := 1; i <= o.PvStringCount; i++ {
+			generated.Measurements = append(generated.Measurements, fmt.Sprintf("%sEpv%d_day", defaultMeasurementPrefix, i))
+		}
+		metrics[MetricGenerated] = generated
+	}
+	if o.PowerDivisor > 0 {
+		for _, metric := range []string{MetricMaxPv, MetricLoadPower} {
+			source := metrics[metric]
+			source.Scale = 1 / o.PowerDivisor
+			metrics[metric] = source
+		}
+	}
+	if o.PvPowerStrings != nil {
+		config.PvPowerStrings = o.PvPowerStrings
+	}
+
+	if o.MeasurementPrefix != "" {
+		rename := func(measurements []string) []string {
+			renamed := make([]string, len(measurements))
+			for i, measurement := range measurements {
+				if rest, ok := strings.CutPrefix(measurement, defaultMeasurementPrefix); ok {
+					measurement = o.MeasurementPrefix + rest
+				}
+				renamed[i] = measurement
+			}
+			return renamed
+		}
+		for metric, source := range metrics {
+			source.Measurements = rename(source.Measurements)
+			metrics[metric] = source
+		}
+		config.PvPowerStrings = rename(config.PvPowerStrings)
+	}
+
+	config.Metrics = metrics
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxParamsBody bounds the JSON body of a POST /solarshowdown request.
+const maxParamsBody = 64 << 10
+
+// paramsFromBody moves the parameters of a POST /solarshowdown JSON body
+// into r's query string, so the handler reads them as it does for GET.
+// Values may be strings, numbers, booleans or arrays of strings, which are
+// joined with commas like ?fields= and ?timeframes=. Body parameters
+// replace query string parameters of the same name.
+func paramsFromBody(w http.ResponseWriter, r *http.Request) error {
+	var body map[string]any
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxParamsBody))
+	if err := decoder.Decode(&body); err != nil {
+		return fmt.Errorf("invalid request body: expected a JSON object of parameters: %v", err)
+	}
+
+	query := r.URL.Query()
+	for name, value := range body {
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case bool:
+			s = strconv.FormatBool(v)
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				str, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("invalid request body: %s must be a list of strings", name)
+				}
+				items[i] = str
+			}
+			s = strings.Join(items, ",")
+		default:
+			return fmt.Errorf("invalid request body: %s must be a string, number, boolean or list of strings", name)
+		}
+		query.Set(name, s)
+	}
+	r.URL.RawQuery = query.Encode()
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// profileMetrics are the metrics ?profileMetric= accepts.
+var profileMetrics = []string{MetricGenerated, MetricConsumed, MetricExported, MetricImported, MetricDischarged, MetricMaxPv}
+
+// Profile summarizes a metric's readings in each hour of the timeframe.
+type Profile struct {
+	Metric  string          `json:"metric"`
+	Every   string          `json:"every"`
+	Windows []ProfileWindow `json:"windows"`
+}
+
+// ProfileWindow holds the min, max and mean of the readings in one window,
+// in the metric's unit. A metric read from several measurements has each
+// statistic summed across them.
+type ProfileWindow struct {
+	Start time.Time `json:"start"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Mean  float64   `json:"mean"`
+}
+
+// queryProfile returns the hourly Profile of metric over timeframe, oldest
+// window first. Hours without readings are left out.
+func queryProfile(ctx context.Context, client influxdb2.Client, config *Config, timeframe, metric string) ([]ProfileWindow, error) {
+	config = downsampledConfig(config, timeframe)
+	start, stop, err := calculateRange(config, timeframe)
+	if err != nil {
+		return nil, err
+	}
+
+	windows := make(map[time.Time]*ProfileWindow)
+	if config.DemoMode {
+		// The synthetic data has one value per hour
+		for hour, value := range demoHourlyDeltas(config, metric, start, stop) {
+			windows[hour] = &ProfileWindow{Start: hour, Min: value, Max: value, Mean: value}
+		}
+		return sortedWindows(config, metric, windows), nil
+	}
+
+	source := config.Metrics[metric]
+	query := fmt.Sprintf(`
+		data = from(bucket:"%[1]s")
+			|> range(%[2]s)
+			|> %[3]s
+			|> filter(fn: (r) => r["%[5]s"] == "%[4]s")
+
+		union(tables: [
+			data |> aggregateWindow(every: 1h, fn: min, createEmpty: false, timeSrc: "_start") |> set(key: "stat", value: "min"),
+			data |> aggregateWindow(every: 1h, fn: max, createEmpty: false, timeSrc: "_start") |> set(key: "stat", value: "max"),
+			data |> aggregateWindow(every: 1h, fn: mean, createEmpty: false, timeSrc: "_start") |> set(key: "stat", value: "mean"),
+		])
+			|> group(columns: ["_time", "stat"])
+			|> sum()`,
+		config.InfluxDBBucket,
+		fluxRange(start, stop),
+		seriesFilter(config, source.Measurements...),
+		config.Dongle,
+		config.TagKey)
+
+	if err := acquireQuerySlot(ctx); err != nil {
+		return nil, fmt.Errorf("waiting to query the %s profile: %w", metric, err)
+	}
+	defer releaseQuerySlot()
+	defer observeQuery(ctx, config, metric+" profile", time.Now())
+
+	result, err := client.QueryAPI(config.InfluxDBOrg).Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed for the %s profile: %w", metric, err)
+	}
+	defer result.Close()
+
+	for result.Next() {
+		record := result.Record()
+		value, err := numericValue(config, record.Value(), metric)
+		if err != nil {
+			return nil, fmt.Errorf("reading result for the %s profile: %w", metric, err)
+		}
+		window, ok := windows[record.Time()]
+		if !ok {
+			window = &ProfileWindow{Start: record.Time()}
+			windows[record.Time()] = window
+		}
+		value *= source.Scale
+		switch record.ValueByKey("stat") {
+		case "min":
+			window.Min = value
+		case "max":
+			window.Max = value
+		case "mean":
+			window.Mean = value
+		}
+	}
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("reading result for the %s profile: %w", metric, err)
+	}
+
+	return sortedWindows(config, metric, windows), nil
+}
+
+// sortedWindows orders windows by start and converts energy readings to
+// ENERGY_UNIT.
+func sortedWindows(config *Config, metric string, windows map[time.Time]*ProfileWindow) []ProfileWindow {
+	result := make([]ProfileWindow, 0, len(windows))
+	for _, start := range slices.SortedFunc(maps.Keys(windows), time.Time.Compare) {
+		window := *windows[start]
+		if metric != MetricMaxPv {
+			window.Min = convertEnergy(config, window.Min)
+			window.Max = convertEnergy(config, window.Max)
+			window.Mean = convertEnergy(config, window.Mean)
+		}
+		window.Start = config.responseTime(window.Start)
+		result = append(result, window)
+	}
+	return result
+}
+
+// queryBackendProfile sums queryProfile across every backend, window by
+// window.
+func queryBackendProfile(ctx context.Context, backends []backend, config *Config, timeframe, metric string) (*Profile, error) {
+	perBackend := make([][]ProfileWindow, len(backends))
+	err := fanOut(ctx, backends, func(ctx context.Context, i int, b backend) error {
+		var err error
+		perBackend[i], err = queryProfile(ctx, b.client, b.config, timeframe, metric)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	windows := make(map[time.Time]*ProfileWindow)
+	for _, backendWindows := range perBackend {
+		for _, w := range backendWindows {
+			total, ok := windows[w.Start]
+			if !ok {
+				total = &ProfileWindow{Start: w.Start}
+				windows[w.Start] = total
+			}
+			total.Min += w.Min
+			total.Max += w.Max
+			total.Mean += w.Mean
+		}
+	}
+
+	profile := &Profile{Metric: metric, Every: "1h", Windows: make([]ProfileWindow, 0, len(windows))}
+	for _, start := range slices.SortedFunc(maps.Keys(windows), time.Time.Compare) {
+		profile.Windows = append(profile.Windows, *windows[start])
+	}
+	return profile, nil
+}
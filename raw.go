@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+type rawRequestKey struct{}
+
+type rawValuesKey struct{}
+
+// rawValues collects each measurement's queried value, before scaling and
+// summing, for ?raw=true.
+type rawValues struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// withRawRequested marks ctx as wanting Response.Raw.
+func withRawRequested(ctx context.Context) context.Context {
+	return context.WithValue(ctx, rawRequestKey{}, true)
+}
+
+func rawRequested(ctx context.Context) bool {
+	requested, _ := ctx.Value(rawRequestKey{}).(bool)
+	return requested
+}
+
+// withRawValues attaches a collector that recordRaw fills.
+func withRawValues(ctx context.Context) (context.Context, *rawValues) {
+	raw := &rawValues{values: make(map[string]float64)}
+	return context.WithValue(ctx, rawValuesKey{}, raw), raw
+}
+
+// recordRaw notes a measurement's value if ctx is collecting them.
+func recordRaw(ctx context.Context, measurement string, value float64) {
+	raw, ok := ctx.Value(rawValuesKey{}).(*rawValues)
+	if !ok {
+		return
+	}
+	raw.mu.Lock()
+	raw.values[measurement] = value
+	raw.mu.Unlock()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// reloadGrace is how long the clients of a replaced configuration are kept
+// open for requests still using them.
+const reloadGrace = time.Minute
+
+// configFile is the CONFIG_FILE of KEY=VALUE lines read into the
+// environment before loadConfig, and again on SIGHUP. Its values take
+// precedence over the process environment.
+type configFile struct {
+	path string
+	// keys were set from the file, and are unset again if removed from it
+	keys []string
+}
+
+// apply reads the file and sets its variables.
+func (f *configFile) apply() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("reading CONFIG_FILE: %w", err)
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return fmt.Errorf("invalid CONFIG_FILE line %d: expected KEY=VALUE", n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading CONFIG_FILE: %w", err)
+	}
+
+	for _, key := range f.keys {
+		if _, ok := values[key]; !ok {
+			os.Unsetenv(key)
+		}
+	}
+	f.keys = f.keys[:0]
+	for key, value := range values {
+		os.Setenv(key, value)
+		f.keys = append(f.keys, key)
+	}
+	return nil
+}
+
+// server is the routes built from one configuration, swapped as a whole on
+// reload so that no request sees a mix of old and new settings.
+type server struct {
+	config        *Config
+	handler       http.Handler
+	closeBackends func()
+	stopWebhook   context.CancelFunc
+}
+
+// newServer creates the backends and routes for config. The cache and
+// warmup outlive configurations.
+func newServer(config *Config, cache *responseCache, warm func([]backend) *warmup) *server {
+	backends, closeBackends := newBackends(config)
+	wu := warm(backends)
+
+	webhookCtx, stopWebhook := context.WithCancel(context.Background())
+	if config.WebhookURL != "" {
+		go runWebhook(webhookCtx, backends, config)
+	}
+
+	routes := []route{
+		{"/solarshowdown", requireWarm(wu, handleSolarShowdown(backends, config, cache))},
+		{"/daily", requireWarm(wu, handleDaily(backends, config))},
+		{"/streak", requireWarm(wu, handleStreak(backends, config))},
+		{"/best-day", requireWarm(wu, handleBestDay(backends, config))},
+		{"/leaderboard", requireWarm(wu, handleLeaderboard(backends, config))},
+		{"/fleet", requireWarm(wu, handleFleet(backends, config))},
+		{"/reset-time", handleResetTime(config)},
+		{"/schema", handleSchema(config)},
+		{"/livez", handleLivez()},
+		{"/readyz", handleReadyz(backends, config)},
+		{"/admin/cache/clear", requireAdmin(config, handleCacheClear(cache))},
+		{"/debug/config", requireAdmin(config, handleDebugConfig(config))},
+		{"/debug/queries", requireAdmin(config, handleDebugQueries(backends, config))},
+		{"/selftest", requireAdmin(config, handleSelftest(backends, config))},
+	}
+	mux := http.NewServeMux()
+	for _, rt := range routes {
+		mux.HandleFunc(rt.pattern, rt.handler)
+	}
+	notFound := handleNotFound(routes)
+	if config.ServeUI {
+		mux.HandleFunc("/", handleUI(notFound))
+	} else {
+		mux.HandleFunc("/", notFound)
+	}
+
+	return &server{
+		config:        config,
+		handler:       withRequestID(withClientIP(config, withGzip(config, mux))),
+		closeBackends: closeBackends,
+		stopWebhook:   stopWebhook,
+	}
+}
+
+// keepRestartOnly copies the settings that only take effect at startup
+// from old to config, logging any that changed.
+func keepRestartOnly(old, config *Config) {
+	restartOnly := []struct {
+		name       string
+		old, value any
+		keep       func()
+	}{
+		{"SERVER_PORT", old.ServerPort, config.ServerPort, func() { config.ServerPort = old.ServerPort }},
+		{"BIND_ADDRESS", old.BindAddress, config.BindAddress, func() { config.BindAddress = old.BindAddress }},
+		{"MAX_CONCURRENT_QUERIES", old.MaxConcurrentQueries, config.MaxConcurrentQueries, func() { config.MaxConcurrentQueries = old.MaxConcurrentQueries }},
+		{"CACHE_MAX_ENTRIES", old.CacheMaxEntries, config.CacheMaxEntries, func() { config.CacheMaxEntries = old.CacheMaxEntries }},
+		{"SERVE_STALE_MAX_AGE", old.ServeStaleMaxAge, config.ServeStaleMaxAge, func() { config.ServeStaleMaxAge = old.ServeStaleMaxAge }},
+		{"INFLUXDB_CLIENT_LOG_LEVEL", old.ClientLogLevel, config.ClientLogLevel, func() { config.ClientLogLevel = old.ClientLogLevel }},
+	}
+	for _, setting := range restartOnly {
+		if setting.old != setting.value {
+			log.Printf("Reload: %s changed from %v to %v but only applies at startup, ignoring", setting.name, setting.old, setting.value)
+			setting.keep()
+		}
+	}
+}
+
+// reloadOnHangup reloads CONFIG_FILE on every SIGHUP and swaps in a server
+// built from it. An invalid file leaves the running configuration in place.
+func reloadOnHangup(file *configFile, current *atomic.Pointer[server], cache *responseCache, warm func([]backend) *warmup) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		if file == nil {
+			log.Printf("Reload: SIGHUP ignored, CONFIG_FILE is not set")
+			continue
+		}
+		if err := file.apply(); err != nil {
+			log.Printf("Reload failed, keeping the running configuration: %v", err)
+			continue
+		}
+		config, err := loadConfig()
+		if err != nil {
+			log.Printf("Reload failed, keeping the running configuration: %v", err)
+			continue
+		}
+		old := current.Load()
+		keepRestartOnly(old.config, config)
+		logConfig(config)
+
+		current.Store(newServer(config, cache, warm))
+		old.stopWebhook()
+		time.AfterFunc(reloadGrace, old.closeBackends)
+		// Cached responses were computed with the old settings
+		cache.Clear()
+		log.Printf("Reload: configuration reloaded from %s", file.path)
+	}
+}
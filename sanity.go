@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions taken when a metric exceeds its MAX_DAILY_KWH ceiling.
+const (
+	sanityWarn  = "warn"
+	sanityClamp = "clamp"
+	sanityDrop  = "drop"
+)
+
+// parseDailyCeilings parses MAX_DAILY_KWH, comma-separated metric=kWh
+// pairs for the daily counter metrics.
+func parseDailyCeilings(spec string) (map[string]float64, error) {
+	ceilings := make(map[string]float64)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		metric, v, _ := strings.Cut(entry, "=")
+		if !slices.Contains(counterMetrics, metric) {
+			return nil, fmt.Errorf("invalid MAX_DAILY_KWH entry %q: expected one of %s", entry, strings.Join(counterMetrics, ", "))
+		}
+		kwh, err := strconv.ParseFloat(v, 64)
+		if err != nil || kwh <= 0 {
+			return nil, fmt.Errorf("invalid MAX_DAILY_KWH entry %q: expected a positive number of kWh", entry)
+		}
+		ceilings[metric] = kwh
+	}
+	return ceilings, nil
+}
+
+// rangeCeiling scales metric's daily ceiling to the days [start, stop)
+// touches when its aggregation adds up across days. The max of a daily
+// counter is a single day's reading however long the window, so it keeps
+// the daily ceiling. A zero stop means now.
+func rangeCeiling(config *Config, metric string, start, stop time.Time) float64 {
+	if aggregation := metricAggregation(config, metric, start, stop); aggregation != "sum" && aggregation != "increase" {
+		return config.DailyCeilings[metric]
+	}
+	if stop.IsZero() {
+		stop = config.now()
+	}
+	days := math.Ceil(stop.Sub(start).Hours() / 24)
+	return config.DailyCeilings[metric] * max(days, 1)
+}
+
+// applyCeiling checks a metric's per-measurement values, in kWh, against
+// its ceiling and returns the total to report. Every action logs and adds
+// a warning; clamp reports the ceiling instead, and drop leaves out the
+// largest measurements until the rest fit under it.
+func applyCeiling(ctx context.Context, config *Config, metric string, values []float64, ceiling float64) float64 {
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	if total <= ceiling {
+		return total
+	}
+
+	warning := fmt.Sprintf("%s of %.2f kWh exceeds MAX_DAILY_KWH of %.2f kWh", metric, total, ceiling)
+	switch config.SanityAction {
+	case sanityClamp:
+		warning += ", so it was clamped to the ceiling"
+		total = ceiling
+	case sanityDrop:
+		sorted := slices.Sorted(slices.Values(values))
+		dropped := 0
+		for total > ceiling && len(sorted) > 0 {
+			total -= sorted[len(sorted)-1]
+			sorted = sorted[:len(sorted)-1]
+			dropped++
+		}
+		warning += fmt.Sprintf(", so its %d largest measurement(s) were dropped, leaving %.2f kWh", dropped, total)
+	default:
+		warning += " and is likely a counter glitch"
+	}
+	if config.Dongle != "" {
+		warning = config.Dongle + ": " + warning
+	}
+	logf(ctx, "%s", warning)
+	recordWarning(ctx, warning)
+	return total
+}
+
+type warningsKey struct{}
+
+// queryWarnings collects the warnings raised while querying a Response.
+type queryWarnings struct {
+	mu       sync.Mutex
+	warnings []string
+}
+
+// withWarnings attaches a collector that recordWarning fills.
+func withWarnings(ctx context.Context) (context.Context, *queryWarnings) {
+	w := &queryWarnings{}
+	return context.WithValue(ctx, warningsKey{}, w), w
+}
+
+// recordWarning notes a warning if ctx is collecting them.
+func recordWarning(ctx context.Context, warning string) {
+	w, ok := ctx.Value(warningsKey{}).(*queryWarnings)
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	if !slices.Contains(w.warnings, warning) {
+		w.warnings = append(w.warnings, warning)
+	}
+	w.mu.Unlock()
+}
+
+// list returns the collected warnings.
+func (w *queryWarnings) list() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Clone(w.warnings)
+}
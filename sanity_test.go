@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRangeCeilingMultiDay(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		name      string
+		metric    string
+		timeframe string
+		want      float64
+	}{
+		{"max over a day", MetricGenerated, "day", 60},
+		{"max over a week", MetricGenerated, "week", 60},
+		{"max over a month", MetricGenerated, "month", 60},
+		{"sum over a day", MetricImported, "day", 60},
+		{"sum over a week", MetricImported, "week", 7 * 60},
+		{"sum over a month", MetricImported, "month", 31 * 60},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.Metrics[MetricImported] = MetricSource{Measurements: []string{"grid_import"}, Aggregation: "sum", Scale: 1}
+			config.Clock = func() time.Time { return now }
+			config.DailyCeilings = map[string]float64{tt.metric: 60}
+			start, stop, err := calculateRange(config, tt.timeframe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rangeCeiling(config, tt.metric, start, stop); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A glitched string's 500 kWh day stands out over a week too
+	config := testConfig()
+	config.Clock = func() time.Time { return now }
+	config.DailyCeilings = map[string]float64{MetricGenerated: 60}
+	config.SanityAction = sanityClamp
+	start, stop, err := calculateRange(config, "week")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, warnings := withWarnings(context.Background())
+	if got := applyCeiling(ctx, config, MetricGenerated, []float64{500, 12}, rangeCeiling(config, MetricGenerated, start, stop)); got != 60 {
+		t.Errorf("clamped to %v, want 60", got)
+	}
+	if len(warnings.list()) != 1 {
+		t.Errorf("warnings = %q, want one", warnings.list())
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// TariffWindow is a time-of-use period covering local hours
+// [StartHour, EndHour) of every day. Rates are per kWh.
+type TariffWindow struct {
+	StartHour  int
+	EndHour    int
+	ImportRate float64
+	ExportRate float64
+}
+
+// parseTariffWindows parses TARIFF_WINDOWS, a comma-separated list of
+// "start-end:importRate" or "start-end:importRate/exportRate" entries such as
+// "0-7:0.10,7-16:0.25,16-21:0.40/0.20". Windows without an export rate use
+// defaultExport.
+func parseTariffWindows(spec string, defaultExport float64) ([]TariffWindow, error) {
+	var windows []TariffWindow
+	covered := [24]bool{}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		hours, rates, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid tariff window %q: expected start-end:rate", entry)
+		}
+
+		startStr, endStr, ok := strings.Cut(hours, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid tariff window %q: expected start-end hours", entry)
+		}
+		start, err := strconv.Atoi(startStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tariff window %q: %v", entry, err)
+		}
+		end, err := strconv.Atoi(endStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tariff window %q: %v", entry, err)
+		}
+		if start < 0 || end > 24 || start >= end {
+			return nil, fmt.Errorf("invalid tariff window %q: hours must satisfy 0 <= start < end <= 24", entry)
+		}
+
+		importStr, exportStr, hasExport := strings.Cut(rates, "/")
+		window := TariffWindow{StartHour: start, EndHour: end, ExportRate: defaultExport}
+		if window.ImportRate, err = strconv.ParseFloat(importStr, 64); err != nil || window.ImportRate < 0 {
+			return nil, fmt.Errorf("invalid tariff window %q: bad import rate", entry)
+		}
+		if hasExport {
+			if window.ExportRate, err = strconv.ParseFloat(exportStr, 64); err != nil || window.ExportRate < 0 {
+				return nil, fmt.Errorf("invalid tariff window %q: bad export rate", entry)
+			}
+		}
+
+		for h := start; h < end; h++ {
+			if covered[h] {
+				return nil, fmt.Errorf("invalid tariff window %q: overlaps hour %d", entry, h)
+			}
+			covered[h] = true
+		}
+		windows = append(windows, window)
+	}
+
+	return windows, nil
+}
+
+// ratesAt returns the import and export rates for a local hour, falling
+// back to the flat rates for hours no window covers.
+func ratesAt(config *Config, hour int) (importRate, exportRate float64) {
+	for _, window := range config.TariffWindows {
+		if hour >= window.StartHour && hour < window.EndHour {
+			return window.ImportRate, window.ExportRate
+		}
+	}
+	return config.ImportRate, config.ExportRate
+}
+
+// estimateSavings values the solar energy in response at the configured
+// flat rates: self-consumed generation avoids buying from the grid at the
+// import rate, and exported energy is credited at the export rate.
+func estimateSavings(config *Config, response Response) float64 {
+	selfConsumed := math.Max(response.Generated-response.Exported, 0)
+	return selfConsumed*config.ImportRate + response.Exported*config.ExportRate
+}
+
+// queryHourlyDeltas returns the energy a daily counter measurement
+// accumulated in each hour of [start, stop), keyed by the hour's start. The
+// counter is assumed to read zero at start, as it does for the day
+// timeframes.
+func queryHourlyDeltas(ctx context.Context, client influxdb2.Client, config *Config, measurement string, start, stop time.Time) (map[time.Time]float64, error) {
+	queryAPI := client.QueryAPI(config.InfluxDBOrg)
+
+	query := fmt.Sprintf(`
+		from(bucket:"%[1]s")
+			|> range(%[2]s)
+			|> %[3]s
+			|> filter(fn: (r) => r["%[5]s"] == "%[4]s")
+			|> aggregateWindow(every: 1h, fn: max, createEmpty: false, timeSrc: "_start")`,
+		config.InfluxDBBucket,
+		fluxRange(start, stop),
+		seriesFilter(config, measurement),
+		config.Dongle,
+		config.TagKey)
+
+	if err := acquireQuerySlot(ctx); err != nil {
+		return nil, fmt.Errorf("waiting to query %s: %w", measurement, err)
+	}
+	defer releaseQuerySlot()
+	defer observeQuery(ctx, config, measurement+" hourly", time.Now())
+
+	result, err := queryAPI.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed for %s: %w", measurement, err)
+	}
+	defer result.Close()
+
+	deltas := make(map[time.Time]float64)
+	var previous float64
+	for first := true; result.Next(); first = false {
+		value, err := numericValue(config, result.Record().Value(), measurement)
+		if err != nil {
+			return nil, fmt.Errorf("reading result for %s: %w", measurement, err)
+		}
+		if first && !startsCounterDay(start) {
+			// The window starts mid-day, partway up the counter, as rolling
+			// windows and DAY_START_HOUR days do
+			previous = value
+		}
+
+		delta := value - previous
+		if value < previous {
+			// The counter reset at midnight, so everything it holds is new
+			delta = value
+		}
+		deltas[result.Record().Time()] = delta
+		previous = value
+	}
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("reading result for %s: %w", measurement, err)
+	}
+
+	return deltas, nil
+}
+
+// startsCounterDay reports whether t is when the daily counters reset:
+// local midnight, up to the one-minute offset dayStart allows for.
+func startsCounterDay(t time.Time) bool {
+	local := t.In(time.Local)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.Local)
+	return local.Sub(midnight) <= time.Minute
+}
+
+// queryMetricHourlyDeltas sums queryHourlyDeltas over a metric's source
+// measurements, scaled to kWh.
+func queryMetricHourlyDeltas(ctx context.Context, client influxdb2.Client, config *Config, metric string, start, stop time.Time) (map[time.Time]float64, error) {
+	if config.DemoMode {
+		return demoHourlyDeltas(config, metric, start, stop), nil
+	}
+
+	source := config.Metrics[metric]
+	total := make(map[time.Time]float64)
+
+	for _, measurement := range source.Measurements {
+		deltas, err := queryHourlyDeltas(ctx, client, config, measurement, start, stop)
+		if err != nil {
+			return nil, err
+		}
+		for hour, delta := range deltas {
+			total[hour] += delta * source.Scale
+		}
+	}
+
+	return total, nil
+}
+
+// queryTOUSavings is the time-of-use variant of estimateSavings: generation
+// and export are bucketed by hour and each hour is valued at the rates of
+// the tariff window it falls in.
+func queryTOUSavings(ctx context.Context, client influxdb2.Client, config *Config, timeframe string) (float64, error) {
+	start, stop, err := calculateRange(config, timeframe)
+	if err != nil {
+		return 0, err
+	}
+
+	generated, err := queryMetricHourlyDeltas(ctx, client, config, MetricGenerated, start, stop)
+	if err != nil {
+		return 0, err
+	}
+	exported, err := queryMetricHourlyDeltas(ctx, client, config, MetricExported, start, stop)
+	if err != nil {
+		return 0, err
+	}
+
+	var savings float64
+	for hour, gen := range generated {
+		importRate, exportRate := ratesAt(config, hour.In(time.Local).Hour())
+		selfConsumed := math.Max(gen-exported[hour], 0)
+		savings += selfConsumed*importRate + exported[hour]*exportRate
+	}
+	for hour, exp := range exported {
+		if _, ok := generated[hour]; !ok {
+			_, exportRate := ratesAt(config, hour.In(time.Local).Hour())
+			savings += exp * exportRate
+		}
+	}
+
+	return savings, nil
+}
+
+// formatCurrency renders amount with the configured symbol and decimal
+// places, e.g. "£3.42" or "-£0.10".
+func formatCurrency(config *Config, amount float64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%s%.*f", sign, config.CurrencySymbol, config.CurrencyDecimals, amount)
+}
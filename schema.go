@@ -0,0 +1,80 @@
+package main
+
+import "net/http"
+
+// SchemaField describes one /solarshowdown response field for clients that
+// label and format values generically.
+type SchemaField struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description"`
+	// Always is false for fields that only appear with certain
+	// configuration or query parameters.
+	Always bool `json:"always"`
+}
+
+type SchemaResponse struct {
+	Fields []SchemaField `json:"fields"`
+}
+
+// responseSchema describes the Response fields as this configuration
+// renders them, including FIELD_NAMES and NUMBER_TYPES.
+func responseSchema(config *Config) []SchemaField {
+	energy := config.EnergyUnit
+	fields := []SchemaField{
+		{MetricGenerated, "number", energy, "Solar energy generated", true},
+		{MetricConsumed, "number", energy, "Household energy consumed", true},
+		{MetricExported, "number", energy, "Energy exported to the grid", true},
+		{MetricImported, "number", energy, "Energy imported from the grid", true},
+		{MetricDischarged, "number", energy, "Energy discharged from the battery", true},
+		{MetricMaxPv, "number", "kW", "Peak instantaneous solar power", true},
+		{"surplus", "number", energy, "Generated minus consumed; negative when consumption exceeded generation", true},
+		{"gridIndependencePct", "number", "%", "Share of consumption not imported from the grid; omitted when nothing was consumed", false},
+		{"gridDependencePct", "number", "%", "Share of consumption imported from the grid; omitted when nothing was consumed", false},
+		{"batteryRoundTripPct", "number", "%", "Discharged as a percentage of the energy charged into the battery; omitted when nothing was charged", false},
+		{"projectedDailyGenerated", "number", energy, "Estimated full-day generation from the daylight elapsed, for timeframe=day", false},
+		{"expectedGenerated", "number", energy, "Clear-sky generation of SYSTEM_CAPACITY_KW at LATITUDE/LONGITUDE over the timeframe", false},
+		{"performanceRatioPct", "number", "%", "Generated as a percentage of expectedGenerated", false},
+		{"energyUnit", "string", "", "Unit of the energy fields", true},
+		{"estimatedSavings", "number", config.CurrencySymbol, "Estimated value of the solar energy, with savings configured", false},
+		{"estimatedSavingsFormatted", "string", "", "estimatedSavings with its currency symbol", false},
+		{"estimatedRuntimeMinutes", "number", "min", "Battery runtime at the current load, with BATTERY_CAPACITY_KWH set", false},
+		{"extra", "object", "", "EXTRA_MEASUREMENTS values, in their stored units", false},
+		{"formatted", "object", "", "Display strings with units, with ?formatted=true", false},
+		{"counts", "object", "", "Samples behind each metric, with ?counts=true", false},
+		{"dailyAverage", "object", "", "Per-day totals and averages of the energy fields, with ?average=daily", false},
+		{"profile", "object", "", "Hourly min, max and mean of profileMetric, with ?profile=hourly", false},
+		{"delta", "object", "", "Counter increments since the ?since= cursor's poll", false},
+		{"cursor", "string", "", "Opaque cursor to pass as ?since= on the next poll, with ?since=", false},
+		{"comparison", "object", "", "Previous period's values and percent change, with ?compare=true", false},
+		{"raw", "object", "", "Each measurement's queried value before scaling, with ?raw=true", false},
+		{"missing", "array", "", "Optional fields that failed and were reported as 0", false},
+		{"warnings", "array", "", "Notes on values that are likely misleading", false},
+		{"stale", "boolean", "", "Set when this is a cached response served because InfluxDB failed", false},
+		{"resetGrace", "boolean", "", "Set when the day timeframe still reports the previous day within RESET_GRACE_SECONDS", false},
+		{"lastReading", "string", "", "Time of the newest data point, with MAX_DATA_AGE set", false},
+		{"dataStale", "boolean", "", "Set when nothing was written within MAX_DATA_AGE", false},
+		{"partial", "boolean", "", "Set, with status 206, when SOFT_DEADLINE passed before every query finished; the unresolved fields are null", false},
+		{"queryDurationMs", "number", "ms", "Time spent querying InfluxDB, with ?timing=true", false},
+		{"slowQueries", "object", "ms", "Queries over SLOW_QUERY_MS by measurement, with ?timing=true", false},
+	}
+
+	for i, field := range fields {
+		if config.NumberTypes[field.Name] == "int" {
+			fields[i].Type = "integer"
+		}
+		if name, ok := config.FieldNames[field.Name]; ok {
+			fields[i].Name = name
+		}
+	}
+	return fields
+}
+
+// handleSchema serves the response field metadata.
+func handleSchema(config *Config) http.HandlerFunc {
+	schema := SchemaResponse{Fields: responseSchema(config)}
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, schema)
+	}
+}
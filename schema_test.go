@@ -0,0 +1,23 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSchemaCoversResponse(t *testing.T) {
+	schema := responseSchema(&Config{})
+	response := reflect.TypeFor[Response]()
+	for i := range response.NumField() {
+		field := response.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "error" || name == "errorCode" {
+			continue
+		}
+		if !slices.ContainsFunc(schema, func(f SchemaField) bool { return f.Name == name }) {
+			t.Errorf("/schema doesn't describe %s", name)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// selftestWindow is how recently each measurement must have been written
+// to pass /selftest.
+const selftestWindow = time.Hour
+
+// selftestTimeout bounds the whole /selftest run.
+const selftestTimeout = 10 * time.Second
+
+// SelftestCheck is the /selftest result for one measurement of one dongle.
+type SelftestCheck struct {
+	Dongle      string `json:"dongle"`
+	Measurement string `json:"measurement"`
+	// Status is "ok", "no_data" or "error"
+	Status string `json:"status"`
+	Points int64  `json:"points"`
+	Error  string `json:"error,omitempty"`
+}
+
+type SelftestResponse struct {
+	Status string          `json:"status"`
+	Checks []SelftestCheck `json:"checks"`
+}
+
+// configuredMeasurements lists every measurement the configuration reads,
+// once each.
+func configuredMeasurements(config *Config) []string {
+	var measurements []string
+	for _, source := range config.Metrics {
+		measurements = append(measurements, source.Measurements...)
+	}
+	for _, extra := range config.ExtraMeasurements {
+		measurements = append(measurements, extra.Measurement)
+	}
+	measurements = append(measurements, config.PvPowerStrings...)
+	slices.Sort(measurements)
+	return slices.Compact(measurements)
+}
+
+// countPoints returns how many points measurement has in [start, stop).
+func countPoints(ctx context.Context, client influxdb2.Client, config *Config, measurement string, start, stop time.Time) (int64, error) {
+	query := fmt.Sprintf(`
+		from(bucket:"%[1]s")
+			|> range(%[2]s)
+			|> %[3]s
+			|> filter(fn: (r) => r["%[5]s"] == "%[4]s")
+			|> count()`,
+		config.InfluxDBBucket,
+		fluxRange(start, stop),
+		seriesFilter(config, measurement),
+		config.Dongle,
+		config.TagKey)
+
+	if err := acquireQuerySlot(ctx); err != nil {
+		return 0, fmt.Errorf("waiting to query %s: %w", measurement, err)
+	}
+	defer releaseQuerySlot()
+	defer observeQuery(ctx, config, measurement+" count", time.Now())
+
+	result, err := client.QueryAPI(config.InfluxDBOrg).Query(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("query failed for %s: %w", measurement, err)
+	}
+	defer result.Close()
+
+	var points int64
+	for result.Next() {
+		if n, ok := result.Record().Value().(int64); ok {
+			points += n
+		}
+	}
+	return points, result.Err()
+}
+
+// handleSelftest checks that every configured measurement of every backend
+// was written within selftestWindow, answering 503 when any wasn't. It only
+// reads, and runs the checks concurrently.
+func handleSelftest(backends []backend, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if config.DemoMode {
+			writeJSON(w, http.StatusOK, SelftestResponse{Status: "ok", Checks: []SelftestCheck{}})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), selftestTimeout)
+		defer cancel()
+		// Relative to the pinned clock, if any, like the timeframes
+		now := config.now()
+		start, stop := now.Add(-selftestWindow).UTC(), zeroTime
+		if config.Clock != nil {
+			stop = now.UTC()
+		}
+
+		var (
+			checks []SelftestCheck
+			mu     sync.Mutex
+			wg     sync.WaitGroup
+		)
+		for _, b := range backends {
+			for _, measurement := range configuredMeasurements(b.config) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					check := SelftestCheck{Dongle: b.config.Dongle, Measurement: measurement, Status: "ok"}
+					points, err := countPoints(ctx, b.client, b.config, measurement, start, stop)
+					switch {
+					case err != nil:
+						check.Status, check.Error = "error", err.Error()
+					case points == 0:
+						check.Status = "no_data"
+					}
+					check.Points = points
+					mu.Lock()
+					checks = append(checks, check)
+					mu.Unlock()
+				}()
+			}
+		}
+		wg.Wait()
+
+		slices.SortFunc(checks, func(a, b SelftestCheck) int {
+			if a.Dongle != b.Dongle {
+				return strings.Compare(a.Dongle, b.Dongle)
+			}
+			return strings.Compare(a.Measurement, b.Measurement)
+		})
+
+		status, code := "ok", http.StatusOK
+		for _, check := range checks {
+			if check.Status != "ok" {
+				status, code = "failing", http.StatusServiceUnavailable
+			}
+		}
+		writeJSON(w, code, SelftestResponse{Status: status, Checks: checks})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errFlightAborted is returned to waiters when the shared call panicked.
+var errFlightAborted = errors.New("shared query did not complete")
+
+// flight is one in-progress query set that identical requests wait on.
+type flight struct {
+	done     chan struct{}
+	response Response
+	err      error
+}
+
+// flightGroup deduplicates concurrent queries for the same cache key, so a
+// dashboard loading several panels at once queries InfluxDB once on a cold
+// cache rather than once per panel.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// queryFlights coalesces the /solarshowdown queries of every request.
+var queryFlights flightGroup
+
+// do runs fn unless a call for key is already running, in which case it
+// waits for that call, or for ctx to end, and returns its result. shared
+// reports the latter.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (Response, error)) (response Response, err error, shared bool) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.response, f.err, true
+		case <-ctx.Done():
+			return Response{}, ctx.Err(), true
+		}
+	}
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f := &flight{done: make(chan struct{}), err: errFlightAborted}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.response, f.err = fn()
+	return f.response, f.err, false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchResponseCoalescesOverlappingKeys(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries = make(map[string]int)
+	)
+	client := fakeInfluxDB(t, func(query string) string {
+		mu.Lock()
+		queries[query]++
+		mu.Unlock()
+		// Long enough for the requests to overlap
+		time.Sleep(50 * time.Millisecond)
+		return ",,0,2024-01-01T00:00:00Z,2024-01-02T00:00:00Z,7.5,m"
+	})
+
+	now := time.Date(2024, 6, 21, 15, 0, 0, 0, time.UTC)
+	config := testConfig()
+	config.Clock = func() time.Time { return now }
+	config.CoalesceQueries = true
+	config.CacheTTLs = map[string]time.Duration{"day": time.Minute, "week": time.Minute}
+	backends := []backend{{client: client, config: config}}
+	cache := newResponseCache(0, 0)
+
+	// Each main entry is shared with the requests comparing against the
+	// previous period, whose derived entries overlap in turn
+	targets := []struct {
+		timeframe, query string
+	}{
+		{"day", "fields=generated"},
+		{"day", "fields=generated&compare=true"},
+		{"week", "fields=generated"},
+		{"week", "fields=generated&compare=true"},
+	}
+	fields := fieldSet{MetricGenerated: true}
+
+	// Every entry a flight fills must be in the cache by the time the
+	// flight is gone, or a request arriving in between queries again
+	keys := []string{"day?fields=generated", "day?fields=generated?previous", "week?fields=generated", "week?fields=generated?previous"}
+	done := make(chan struct{})
+	watched := make(chan []string)
+	go func() {
+		var missed []string
+		seen := make(map[string]bool)
+		for {
+			queryFlights.mu.Lock()
+			for _, key := range keys {
+				if _, ok := queryFlights.flights[key]; ok {
+					seen[key] = true
+				} else if seen[key] {
+					if _, ok := cache.Get(key); !ok {
+						missed = append(missed, key)
+					}
+					seen[key] = false
+				}
+			}
+			queryFlights.mu.Unlock()
+			select {
+			case <-done:
+				watched <- missed
+				return
+			default:
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := range 40 {
+		target := targets[i%len(targets)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/solarshowdown?"+target.query, nil)
+			response, err := fetchResponse(r, backends, config, cache, target.timeframe, fields)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if response.Generated != 22.5 {
+				t.Errorf("got generated %v, want 22.5", response.Generated)
+			}
+			if strings.Contains(target.query, "compare") && response.Comparison == nil {
+				t.Error("got no comparison")
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	if missed := <-watched; len(missed) > 0 {
+		t.Errorf("flights for %v ended before their entry was cached", missed)
+	}
+	// Three generated measurements, for each period of each timeframe
+	if len(queries) != 12 {
+		t.Errorf("got %d distinct queries, want 12", len(queries))
+	}
+	for query, n := range queries {
+		if n != 1 {
+			t.Errorf("query ran %d times, want once:\n%s", n, query)
+		}
+	}
+	for _, key := range keys {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("%s is not cached", key)
+		}
+	}
+}
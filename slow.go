@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type slowQueriesKey struct{}
+
+// slowQueries collects the duration in milliseconds of each query over
+// SLOW_QUERY_MS, for ?timing=true.
+type slowQueries struct {
+	mu sync.Mutex
+	ms map[string]float64
+}
+
+// withSlowQueries attaches a collector that observeQuery fills.
+func withSlowQueries(ctx context.Context) (context.Context, *slowQueries) {
+	slow := &slowQueries{ms: make(map[string]float64)}
+	return context.WithValue(ctx, slowQueriesKey{}, slow), slow
+}
+
+// observeQuery logs the query on name begun at start if it took longer
+// than SLOW_QUERY_MS, and notes it if ctx is collecting slow queries.
+func observeQuery(ctx context.Context, config *Config, name string, start time.Time) {
+	elapsed := time.Since(start)
+	if config.SlowQuery == 0 || elapsed < config.SlowQuery {
+		return
+	}
+	logf(ctx, "Slow query for %s: took %s, over %s", name, elapsed.Round(time.Millisecond), config.SlowQuery)
+
+	slow, ok := ctx.Value(slowQueriesKey{}).(*slowQueries)
+	if !ok {
+		return
+	}
+	ms := float64(elapsed.Microseconds()) / 1000
+	slow.mu.Lock()
+	// With several backends the same measurement is queried once for each
+	slow.ms[name] = max(slow.ms[name], ms)
+	slow.mu.Unlock()
+}
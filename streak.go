@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type StreakResponse struct {
+	// Days is the number of consecutive completed days, ending yesterday,
+	// whose imports stayed within ThresholdKWh.
+	Days int `json:"days"`
+	// Since is the first day of the streak, empty when Days is zero.
+	Since        string  `json:"since,omitempty"`
+	ThresholdKWh float64 `json:"thresholdKWh"`
+	// Capped is set when the streak reached STREAK_MAX_DAYS and may be
+	// longer.
+	Capped bool `json:"capped"`
+}
+
+// queryImportedDay returns the energy imported across every backend in
+// [start, stop), in kWh.
+func queryImportedDay(ctx context.Context, backends []backend, start, stop time.Time) (float64, error) {
+	imported := make([]float64, len(backends))
+	err := fanOut(ctx, backends, func(ctx context.Context, i int, b backend) error {
+		var err error
+		imported[i], err = queryMetricRange(ctx, b.client, b.config, MetricImported, start, stop)
+		return err
+	})
+	var total float64
+	for _, value := range imported {
+		total += value
+	}
+	return total, err
+}
+
+// queryStreak walks back from yesterday one day at a time until a day
+// imported more than STREAK_THRESHOLD_KWH or STREAK_MAX_DAYS is reached.
+func queryStreak(ctx context.Context, backends []backend, config *Config) (StreakResponse, error) {
+	streak := StreakResponse{ThresholdKWh: config.StreakThresholdKWh}
+	stop := dayStart(config, config.now())
+	for streak.Days < config.StreakMaxDays {
+		start := dayStart(config, stop.AddDate(0, 0, -1))
+		imported, err := queryImportedDay(ctx, backends, start, stop)
+		if err != nil {
+			return StreakResponse{}, err
+		}
+		if imported > config.StreakThresholdKWh {
+			return streak, nil
+		}
+		streak.Days++
+		streak.Since = start.In(time.Local).Format(time.DateOnly)
+		stop = start
+	}
+	streak.Capped = true
+	return streak, nil
+}
+
+// handleStreak serves the current run of days without grid imports.
+func handleStreak(backends []backend, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		streak, err := queryStreak(r.Context(), backends, config)
+		if err != nil {
+			writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error(), ErrorCode: errorCode(err)})
+			return
+		}
+
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Type", "application/json")
+			return
+		}
+		writeJSON(w, http.StatusOK, streak)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// parseTimeframes parses the comma-separated ?timeframes= parameter,
+// dropping duplicates, and names the first unsupported entry.
+func parseTimeframes(config *Config, list string) ([]string, error) {
+	var result []string
+	for _, timeframe := range strings.Split(list, ",") {
+		timeframe = strings.TrimSpace(timeframe)
+		if _, _, err := calculateRange(config, timeframe); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(result, timeframe) {
+			result = append(result, timeframe)
+		}
+	}
+	return result, nil
+}
+
+// serveTimeframes answers ?timeframes= with a JSON object mapping each
+// requested timeframe to its Response, fetched concurrently.
+func serveTimeframes(w http.ResponseWriter, r *http.Request, backends []backend, config *Config, cache *responseCache, list string, fields fieldSet) {
+	requested, err := parseTimeframes(config, list)
+	if err != nil {
+		writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidTimeframe, err)
+		return
+	}
+	for _, timeframe := range requested {
+		if !config.timeframeAllowed(timeframe) {
+			writeResponseError(w, http.StatusForbidden, ErrorCodeTimeframeNotAllowed, fmt.Errorf("timeframe not allowed: %s", timeframe))
+			return
+		}
+	}
+	if format := r.URL.Query().Get("format"); format != "" && format != "json" {
+		writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, fmt.Errorf("format %s is not available with timeframes", format))
+		return
+	}
+	if err := validateOptions(r); err != nil {
+		writeResponseError(w, http.StatusBadRequest, ErrorCodeInvalidParameter, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	var (
+		responses = make([]Response, len(requested))
+		wg        sync.WaitGroup
+		once      sync.Once
+		firstErr  error
+	)
+	for i, timeframe := range requested {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := fetchResponse(r, backends, config, cache, timeframe, fields)
+			if err != nil {
+				once.Do(func() {
+					firstErr = fmt.Errorf("%s: %w", timeframe, err)
+					cancel()
+				})
+				return
+			}
+			responses[i] = response
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		writeResponseError(w, errorStatus(firstErr), errorCode(firstErr), firstErr)
+		return
+	}
+
+	// The shortest-lived timeframe bounds how long the whole set may be cached
+	shortest := requested[0]
+	stale, status, dataStale := false, http.StatusOK, false
+	for i, timeframe := range requested {
+		stale = stale || responses[i].Stale || responses[i].Partial || responses[i].DataStale
+		if responses[i].Partial && status == http.StatusOK {
+			status = http.StatusPartialContent
+		}
+		if responses[i].DataStale && config.StaleDataError {
+			status, dataStale = http.StatusServiceUnavailable, true
+			responses[i].Error, responses[i].ErrorCode = dataStaleError(config), ErrorCodeDataStale
+		}
+		if config.cacheTTL(timeframe) < config.cacheTTL(shortest) {
+			shortest = timeframe
+		}
+	}
+	setCacheControl(w, config, shortest, stale)
+
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		return
+	}
+
+	body := make(map[string]any, len(requested))
+	for i, timeframe := range requested {
+		if body[timeframe], err = encodeResponse(config, responses[i], fields); err != nil {
+			writeResponseError(w, http.StatusInternalServerError, ErrorCodeQueryFailed, err)
+			return
+		}
+	}
+	if dataStale {
+		// Like every other error response, carry the code at the top level
+		body["error"], body["errorCode"] = dataStaleError(config), ErrorCodeDataStale
+	}
+	writeJSON(w, status, body)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed ui/index.html
+var dashboardHTML []byte
+
+// handleUI serves the embedded dashboard at "/" with SERVE_UI, passing
+// every other unregistered path on to notFound.
+func handleUI(notFound http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			notFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression (minute, hour, day of
+// month, month, day of week), evaluated in local time. Each field is a
+// bitmask of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// As in cron, when both day fields are restricted a day matching
+	// either one matches
+	domAny, dowAny bool
+}
+
+// parseCron parses a cron expression such as "0 21 * * *". Fields accept
+// "*", values, ranges ("1-5"), lists ("1,15") and steps ("*/15").
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields", spec)
+	}
+
+	var s cronSchedule
+	var err error
+	for i, f := range []struct {
+		dst      *uint64
+		min, max int
+	}{{&s.minute, 0, 59}, {&s.hour, 0, 23}, {&s.dom, 1, 31}, {&s.month, 1, 12}, {&s.dow, 0, 7}} {
+		if *f.dst, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v", spec, err)
+		}
+	}
+	// 7 is Sunday too
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+
+	return &s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			loText, hiText, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loText); err != nil {
+				return 0, fmt.Errorf("bad value in %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiText); err != nil {
+					return 0, fmt.Errorf("bad range in %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next returns the first time after t that the schedule matches, or the
+// zero time if it never does (such as "0 0 31 2 *").
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(time.Local).Truncate(time.Minute).Add(time.Minute)
+	// Four years covers every leap-day schedule
+	for limit := t.AddDate(4, 0, 0); t.Before(limit); {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.Local)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.Local)
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.Local)
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// webhookRetries is how many times a failed delivery is retried, with the
+// delay doubling from webhookRetryDelay.
+const (
+	webhookRetries    = 3
+	webhookRetryDelay = 30 * time.Second
+)
+
+// runWebhook POSTs the Response for WEBHOOK_TIMEFRAME to WEBHOOK_URL at
+// every WEBHOOK_SCHEDULE time until ctx is done.
+func runWebhook(ctx context.Context, backends []backend, config *Config) {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	for {
+		next := config.WebhookSchedule.next(time.Now())
+		if next.IsZero() {
+			log.Printf("Webhook schedule never fires, stopping")
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		delay := webhookRetryDelay
+		for attempt := 0; ; attempt++ {
+			err := deliverWebhook(ctx, client, backends, config)
+			if err == nil {
+				log.Printf("Webhook delivered %s response", config.WebhookTimeframe)
+				break
+			}
+			if attempt == webhookRetries {
+				log.Printf("Webhook delivery failed, giving up until the next run: %v", err)
+				break
+			}
+			log.Printf("Webhook delivery failed, retrying in %s: %v", delay, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+	}
+}
+
+// deliverWebhook computes the Response and POSTs it once.
+func deliverWebhook(ctx context.Context, client *http.Client, backends []backend, config *Config) error {
+	queryCtx := ctx
+	if config.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		queryCtx, cancel = context.WithTimeout(ctx, config.QueryTimeout)
+		defer cancel()
+	}
+
+	response, err := queryBackends(queryCtx, backends, config, config.WebhookTimeframe, nil)
+	if err != nil {
+		return fmt.Errorf("querying %s: %w", config.WebhookTimeframe, err)
+	}
+	body, err := encodeResponse(config, response, nil)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.WebhookURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}